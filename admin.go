@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+)
+
+func adminCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: dockersh admin ps [--json]\n")
+		fmt.Fprintf(os.Stderr, "       dockersh admin kill [--profile name] <user>\n")
+		fmt.Fprintf(os.Stderr, "       dockersh admin reset [--profile name] [--volumes] <user>\n")
+		return 2
+	}
+
+	if err := requireAdmin(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "ps":
+		return adminPsCommand(args[1:])
+	case "kill":
+		return adminKillCommand(args[1:])
+	case "reset":
+		return adminResetCommand(args[1:])
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown admin command: %s\n", args[0])
+	return 2
+}
+
+// requireAdmin checks that the user is root, or a member of admingroup. Only
+// admingroup is read from the global config files, and the configuration
+// isn't validated, so that admins can still use the admin commands (e.g. to
+// check the files) when it is invalid.
+func requireAdmin() error {
+	if os.Getuid() == 0 {
+		return nil
+	}
+	username, _, _, _, err := getCurrentUser()
+	if err != nil {
+		return err
+	}
+	files, err := loadGlobalConfigFiles()
+	if err != nil {
+		return fmt.Errorf("Could not load config: %v", err)
+	}
+	adminGroup := composeConfigs(files, username, memberGroups(username)).AdminGroup
+	if adminGroup != "" {
+		ok, err := isMemberOf(adminGroup)
+		if err != nil {
+			return fmt.Errorf("Could not check admin group membership: %v", err)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("Admin commands are restricted to root and the admingroup")
+}
+
+type containerInfo struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	User        string  `json:"user"`
+	Uid         string  `json:"uid"`
+	Image       string  `json:"image"`
+	Profile     string  `json:"profile"`
+	State       string  `json:"state"`
+	Uptime      int64   `json:"uptime"`
+	Sessions    int     `json:"sessions"`
+	MemoryBytes uint64  `json:"memory_bytes"`
+	CPUPercent  float64 `json:"cpu_percent"`
+	ConfigHash  string  `json:"config_hash"`
+}
+
+func adminPsCommand(args []string) int {
+	flags := flag.NewFlagSet("admin ps", flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "Output JSON")
+	flags.Parse(args)
+
+	containers, err := listContainers(true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not list containers: %v\n", err)
+		return 1
+	}
+
+	var infos []containerInfo
+	for _, c := range containers {
+		infos = append(infos, getContainerInfo(c))
+	}
+
+	if *jsonOutput {
+		if infos == nil {
+			infos = []containerInfo{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(infos); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tPROFILE\tIMAGE\tSTATE\tUPTIME\tSESSIONS\tMEMORY\tCPU %\tCONFIG HASH\tCONTAINER ID")
+	for _, i := range infos {
+		hash := i.ConfigHash
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%.2f\t%s\t%s\n",
+			i.User, i.Profile, i.Image, i.State, units.HumanDuration(time.Duration(i.Uptime)*time.Second),
+			i.Sessions, units.BytesSize(float64(i.MemoryBytes)), i.CPUPercent, hash, i.ID[:12])
+	}
+	w.Flush()
+
+	return 0
+}
+
+func getContainerInfo(c types.Container) containerInfo {
+	i := containerInfo{
+		ID:         c.ID,
+		Uid:        c.Labels[userLabel],
+		User:       c.Labels[userLabel],
+		Image:      c.Image,
+		Profile:    c.Labels[profileLabel],
+		State:      c.State,
+		Uptime:     int64(time.Since(time.Unix(c.Created, 0)).Seconds()),
+		ConfigHash: c.Labels[configHashLabel],
+	}
+	if len(c.Names) > 0 {
+		i.Name = c.Names[0][1:]
+	}
+	if u, err := user.LookupId(i.Uid); err == nil {
+		i.User = u.Username
+	}
+
+	if c.State != "running" {
+		return i
+	}
+
+	n, err := activeExecs(c.ID)
+	if err != nil {
+		logrus.Debugf("Could not count sessions of %v: %v", c.ID, err)
+	}
+	i.Sessions = n
+
+	stats, err := containerStats(c.ID)
+	if err != nil {
+		logrus.Debugf("Could not get stats of %v: %v", c.ID, err)
+		return i
+	}
+	i.MemoryBytes = memoryUsage(stats)
+	i.CPUPercent = cpuPercent(stats)
+
+	return i
+}
+
+// memoryUsage returns the memory used by the container, not counting the page
+// cache, like docker stats does.
+func memoryUsage(stats types.StatsJSON) uint64 {
+	cache := stats.MemoryStats.Stats["cache"]
+	if cache > stats.MemoryStats.Usage {
+		return 0
+	}
+	return stats.MemoryStats.Usage - cache
+}
+
+// cpuPercent returns the CPU usage of the container since the previous stats
+// sample, where 100% is one CPU, like docker stats does.
+func cpuPercent(stats types.StatsJSON) float64 {
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	if cpuDelta <= 0 || systemDelta <= 0 {
+		return 0
+	}
+
+	cpus := float64(stats.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+	return cpuDelta / systemDelta * cpus * 100
+}
+
+// lookupUid returns the uid of a user given by name or uid.
+func lookupUid(name string) (int, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		u, err = user.LookupId(name)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unknown user %s", name)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// adminUserContainers parses the user argument and --profile of the kill and
+// reset commands, and returns the containers they act on.
+// adminUserContainers parses the arguments of the admin commands acting on
+// a user's containers, takes the user's lock (so that their logins don't
+// start or use the containers meanwhile) and lists the containers. The
+// returned function releases the lock.
+func adminUserContainers(flags *flag.FlagSet, args []string) ([]types.Container, int, func(), error) {
+	profile := flags.String("profile", "", "Only act on the container of this profile")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return nil, 0, nil, fmt.Errorf("Usage: dockersh admin %s [options] <user>", flags.Name())
+	}
+
+	uid, err := lookupUid(flags.Arg(0))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	unlock, err := lockUser(uid)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("Could not lock user: %v", err)
+	}
+
+	containers, err := userContainers(uid, *profile)
+	if err != nil {
+		unlock()
+		return nil, 0, nil, fmt.Errorf("Could not list containers: %v", err)
+	}
+	if len(containers) == 0 {
+		fmt.Printf("No containers for %s\n", flags.Arg(0))
+	}
+	return containers, uid, unlock, nil
+}
+
+func adminKillCommand(args []string) int {
+	flags := flag.NewFlagSet("kill", flag.ExitOnError)
+	containers, uid, unlock, err := adminUserContainers(flags, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer unlock()
+
+	ret := 0
+	for _, c := range containers {
+		if c.State != "running" {
+			continue
+		}
+		if err := killContainer(c.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not kill container %s: %v\n", c.ID[:12], err)
+			ret = 1
+			continue
+		}
+		fmt.Printf("Killed container %s (profile %s)\n", c.ID[:12], c.Labels[profileLabel])
+
+		removeSessionFiles(uid, c.Labels[profileLabel])
+	}
+
+	return ret
+}
+
+func adminResetCommand(args []string) int {
+	flags := flag.NewFlagSet("reset", flag.ExitOnError)
+	volumes := flags.Bool("volumes", false, "Also remove the named volumes mounted in the containers")
+	containers, uid, unlock, err := adminUserContainers(flags, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer unlock()
+
+	ret := 0
+	for _, c := range containers {
+		if err := removeContainer(c.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not remove container %s: %v\n", c.ID[:12], err)
+			ret = 1
+			continue
+		}
+		fmt.Printf("Removed container %s (profile %s)\n", c.ID[:12], c.Labels[profileLabel])
+
+		removeSessionFiles(uid, c.Labels[profileLabel])
+
+		if !*volumes {
+			continue
+		}
+		for _, m := range c.Mounts {
+			if m.Type != mount.TypeVolume || m.Name == "" {
+				continue
+			}
+			if err := removeVolume(m.Name); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not remove volume %s: %v\n", m.Name, err)
+				ret = 1
+				continue
+			}
+			fmt.Printf("Removed volume %s\n", m.Name)
+		}
+	}
+
+	return ret
+}
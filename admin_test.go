@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func Test_cpuPercent_1(t *testing.T) {
+	var stats types.StatsJSON
+	stats.PreCPUStats.CPUUsage.TotalUsage = 1000
+	stats.PreCPUStats.SystemUsage = 10000
+	stats.CPUStats.CPUUsage.TotalUsage = 1500
+	stats.CPUStats.SystemUsage = 12000
+	stats.CPUStats.OnlineCPUs = 4
+	if p := cpuPercent(stats); p != 100 {
+		t.Errorf("Expected 100 got %v", p)
+	}
+	if p := cpuPercent(types.StatsJSON{}); p != 0 {
+		t.Errorf("Expected 0 got %v", p)
+	}
+}
+
+func Test_memoryUsage_1(t *testing.T) {
+	var stats types.StatsJSON
+	stats.MemoryStats.Usage = 1000
+	stats.MemoryStats.Stats = map[string]uint64{"cache": 400}
+	if m := memoryUsage(stats); m != 600 {
+		t.Errorf("Expected 600 got %v", m)
+	}
+}
+
+func Test_lookupUid_1(t *testing.T) {
+	for _, name := range []string{"root", "0"} {
+		uid, err := lookupUid(name)
+		if err != nil || uid != 0 {
+			t.Errorf("Expected uid 0 for %s got %v (%v)", name, uid, err)
+		}
+	}
+	if _, err := lookupUid("nosuchuserhere"); err == nil {
+		t.Error("No error for unknown user")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// agentContainerDir is where the user's agent directory is mounted inside the
+// container.
+const agentContainerDir = "/run/dockersh-agent"
+
+// agentDir is the host directory holding the agent sockets of a user's
+// sessions. It lives as long as the container, unlike the directory sshd puts
+// SSH_AUTH_SOCK in, which changes with every connection.
+func agentDir(uid int) string {
+	return filepath.Join(lockDir, fmt.Sprintf("agent-%d", uid))
+}
+
+// ensureAgentDir creates the user's agent directory if needed, owned by the
+// host uid and gid the user maps to in the container, and checks it.
+func ensureAgentDir(uid int, hostUid int, hostGid int) (string, error) {
+	if err := checkLockDir(lockDir); err != nil {
+		return "", err
+	}
+	dir := agentDir(uid)
+	if err := makeOwnedDir(dir, hostUid, hostGid); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// makeOwnedDir creates a private directory owned by uid and gid. An existing
+// directory owned by us (dockersh runs as root, so that's one created by root
+// e.g. by the docker daemon) is handed over to them.
+func makeOwnedDir(dir string, uid int, gid int) error {
+	err := os.Mkdir(dir, 0700)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("could not create agent directory %s: %v", dir, err)
+	}
+
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.IsDir() && int(st.Uid) == os.Geteuid() && uid != os.Geteuid() {
+		if err := os.Lchown(dir, uid, gid); err != nil {
+			return fmt.Errorf("could not chown agent directory %s: %v", dir, err)
+		}
+		if err := os.Chmod(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	return checkOwner(dir, uid, true)
+}
+
+// checkOwner checks path is owned by uid, without following symlinks.
+func checkOwner(path string, uid int, dir bool) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if dir && !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != uid {
+		return fmt.Errorf("%s is not owned by uid %d", path, uid)
+	}
+	return nil
+}
+
+// forwardAgent relays connections to a socket in the user's agent directory
+// to the ssh agent of this session, so that it can be used from inside the
+// container. It returns the SSH_AUTH_SOCK value to use in the container, or
+// "" if there is no agent, and a function to stop the relay.
+func forwardAgent(config Configuration) (string, func(), error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return "", func() {}, nil
+	}
+
+	if err := checkOwner(filepath.Dir(sock), config.UserId, true); err != nil {
+		return "", nil, fmt.Errorf("not forwarding ssh agent: %v", err)
+	}
+	if err := checkOwner(sock, config.UserId, false); err != nil {
+		return "", nil, fmt.Errorf("not forwarding ssh agent: %v", err)
+	}
+
+	hostUid, hostGid, err := hostIDs(config)
+	if err != nil {
+		return "", nil, err
+	}
+	dir, err := ensureAgentDir(config.UserId, hostUid, hostGid)
+	if err != nil {
+		return "", nil, err
+	}
+
+	name := fmt.Sprintf("agent.%d", os.Getpid())
+	relay := filepath.Join(dir, name)
+	l, err := listenAgent(relay, hostUid, hostGid)
+	if err != nil {
+		return "", nil, err
+	}
+	logrus.Debugf("Relaying ssh agent %v from %v", sock, relay)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go relayAgent(conn, sock, config.UserId)
+		}
+	}()
+
+	return filepath.Join(agentContainerDir, name), func() { l.Close() }, nil
+}
+
+// listenAgent creates the relay socket, which only uid can connect to.
+func listenAgent(relay string, uid int, gid int) (net.Listener, error) {
+	os.Remove(relay)
+	// Created private, rather than chmod'ed afterwards (which would follow a
+	// symlink put in its place)
+	mask := syscall.Umask(0177)
+	l, err := net.Listen("unix", relay)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Lchown(relay, uid, gid); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("could not chown agent socket %s: %v", relay, err)
+	}
+	return l, nil
+}
+
+// relayAgent relays a connection to the ssh agent at sock. dockersh connects
+// to it as root, so the agent is checked to be run by uid, in case sock was
+// replaced since it was checked.
+func relayAgent(conn net.Conn, sock string, uid int) {
+	defer conn.Close()
+
+	agent, err := net.Dial("unix", sock)
+	if err != nil {
+		logrus.Debugf("Could not connect to ssh agent: %v", err)
+		return
+	}
+	defer agent.Close()
+
+	peer, err := peerUid(agent.(*net.UnixConn))
+	if err != nil {
+		logrus.Debugf("Could not get the uid of the ssh agent: %v", err)
+		return
+	}
+	if peer != uid {
+		logrus.Warnf("Not relaying to ssh agent %v run by uid %d", sock, peer)
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(agent, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, agent)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// peerUid returns the uid of the process at the other end of a unix socket.
+func peerUid(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return int(cred.Uid), nil
+}
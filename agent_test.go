@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func Test_checkOwner_1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockersh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := checkOwner(dir, os.Getuid(), true); err != nil {
+		t.Errorf("Got error %v", err)
+	}
+	if err := checkOwner(dir, os.Getuid()+1, true); err == nil {
+		t.Error("No error for directory owned by another uid")
+	}
+
+	link := filepath.Join(dir, "link")
+	os.Symlink(dir, link)
+	if err := checkOwner(link, os.Getuid(), true); err == nil {
+		t.Error("No error for symlink")
+	}
+}
+
+func Test_relayAgent_1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockersh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "agent")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		b := make([]byte, 4)
+		conn.Read(b)
+		conn.Write(b)
+		conn.Close()
+	}()
+
+	client, server := net.Pipe()
+	go relayAgent(server, sock, os.Geteuid())
+
+	client.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := client.Read(b); err != nil || string(b) != "ping" {
+		t.Errorf("Expected ping got %q (%v)", b, err)
+	}
+	client.Close()
+
+	// An agent run by another uid isn't relayed to
+	client, server = net.Pipe()
+	go relayAgent(server, sock, os.Geteuid()+1)
+	if _, err := client.Read(b); err == nil {
+		t.Error("Relayed to an agent of another uid")
+	}
+	client.Close()
+}
+
+func Test_makeOwnedDir_1(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Needs root to chown")
+	}
+	base, err := ioutil.TempDir("", "dockersh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	// Created, and an existing one created by root, are handed to the user
+	dir := filepath.Join(base, "agent-1000")
+	for i := 0; i < 2; i++ {
+		if err := makeOwnedDir(dir, 1000, 1001); err != nil {
+			t.Fatalf("Error from makeOwnedDir: %v", err)
+		}
+		fi, _ := os.Stat(dir)
+		st := fi.Sys().(*syscall.Stat_t)
+		if st.Uid != 1000 || st.Gid != 1001 || fi.Mode().Perm() != 0700 {
+			t.Errorf("Agent directory is %d:%d %v", st.Uid, st.Gid, fi.Mode())
+		}
+		os.Chown(dir, 0, 0)
+	}
+
+	other := filepath.Join(base, "agent-1002")
+	os.Mkdir(other, 0700)
+	os.Chown(other, 1003, 1003)
+	if err := makeOwnedDir(other, 1002, 1002); err == nil {
+		t.Error("No error for a directory owned by another uid")
+	}
+
+	link := filepath.Join(base, "agent-1004")
+	os.Symlink(base, link)
+	if err := makeOwnedDir(link, 1004, 1004); err == nil {
+		t.Error("No error for a symlink")
+	}
+}
+
+func Test_listenAgent_1(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Needs root to chown")
+	}
+	dir, err := ioutil.TempDir("", "dockersh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	relay := filepath.Join(dir, "agent.1")
+	l, err := listenAgent(relay, 1000, 1001)
+	if err != nil {
+		t.Fatalf("Error from listenAgent: %v", err)
+	}
+	defer l.Close()
+
+	fi, err := os.Lstat(relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	if st.Uid != 1000 || st.Gid != 1001 || fi.Mode().Perm() != 0600 {
+		t.Errorf("Agent socket is %d:%d %v", st.Uid, st.Gid, fi.Mode())
+	}
+}
@@ -1,11 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
 	"gopkg.in/gcfg.v1"
 )
 
@@ -29,6 +41,8 @@ type Configuration struct {
 	EnableUserMountHome         bool
 	MountTmp                    bool
 	EnableUserMountTmp          bool
+	ForwardAgent                bool
+	EnableUserForwardAgent      bool
 	MountDockerSocket           bool
 	EnableUserMountDockerSocket bool
 	DockerSocket                string
@@ -41,8 +55,33 @@ type Configuration struct {
 	EnableUserEnv               bool
 	ReverseForward              []string
 	EnableUserReverseForward    bool
-	UserId                      int
-	GroupId                     int
+	ReverseForwardRange         string
+	AllowCommand                []string
+	DenyCommand                 []string
+	SftpServer                  string
+	PasswdFile                  string
+	ShellFallback               []string
+	IdleTimeout                 string
+	Lifecycle                   string
+	AdminGroup                  string
+	Recycle                     string
+	Memory                      string
+	MemorySwap                  string
+	Cpus                        string
+	CpuShares                   int64
+	PidsLimit                   int64
+	BlkioWeight                 uint16
+	UsernsMode                  string
+	SeccompProfile              string
+	AppArmorProfile             string
+	SelinuxLabel                string
+	NoNewPrivileges             bool
+	CapAdd                      []string
+	CapDrop                     []string
+	// Set by dockersh, so unknown settings in the config files
+	Profile string `gcfg:"-" yaml:"-" toml:"-"`
+	UserId  int    `gcfg:"-" yaml:"-" toml:"-"`
+	GroupId int    `gcfg:"-" yaml:"-" toml:"-"`
 }
 
 func (c Configuration) Dump() string {
@@ -50,8 +89,9 @@ func (c Configuration) Dump() string {
 }
 
 type configInterpolation struct {
-	Home string
-	User string
+	Home  string
+	User  string
+	Shell string
 }
 
 var defaultConfig = Configuration{
@@ -64,6 +104,11 @@ var defaultConfig = Configuration{
 	Shell:             "/bin/ash",
 	DockerSocket:      "/var/run/docker.sock",
 	Entrypoint:        "internal",
+	Recycle:           "idle",
+	Lifecycle:         "persistent",
+	CapDrop:           []string{"SETUID", "SETGID", "NET_RAW", "MKNOD"},
+	PasswdFile:        "/etc/passwd",
+	ShellFallback:     []string{"/bin/bash", "/bin/ash", "/bin/sh"},
 }
 
 func loadAllConfig() (config Configuration, err error) {
@@ -71,32 +116,74 @@ func loadAllConfig() (config Configuration, err error) {
 	if err != nil {
 		return config, err
 	}
-
-	config, err = loadConfig(loadableFile("/etc/dockersh"), username)
+	config, _, err = loadUserConfig(username, homedir, uid, gid)
 	if err != nil {
 		return config, err
 	}
+	return config, validateConfig(config)
+}
+
+// loadUserConfig loads the configuration of a user, and where each setting's
+// value came from. The configuration isn't validated.
+func loadUserConfig(username string, homedir string, uid int, gid int) (config Configuration, sources map[string]settingSource, err error) {
+	groups := memberGroups(username)
+	files, err := loadGlobalConfigFiles()
+	if err != nil {
+		return config, nil, err
+	}
+
+	sources = map[string]settingSource{}
+	config = applyLayer(config, configLayer{Source: "default", Config: defaultConfig}, false, sources)
+	for _, l := range userLayers(files, username, groups) {
+		config = applyLayer(config, l, false, sources)
+	}
 
 	if config.EnableUserConfig == true {
-		userconfig, err := loadConfig(loadableFile(fmt.Sprintf("%s/.dockersh", homedir)), username)
+		fn := fmt.Sprintf("%s/.dockersh", homedir)
+		userconfig, err := loadConfig(loadableFile(fn), username, groups)
 		if err != nil {
-			return config, err
+			return config, sources, err
 		}
-		config = mergeConfigs(mergeConfigs(defaultConfig, config, false), userconfig, true)
-	} else {
-		config = mergeConfigs(defaultConfig, config, false)
+		config = applyLayer(config, configLayer{Source: "~/.dockersh", File: fn, Config: userconfig}, true, sources)
 	}
 
-	configInterpolations := configInterpolation{homedir, username}
+	shell := ""
+	if candidates := shellCandidates(config, username); len(candidates) > 0 {
+		shell = candidates[0]
+	}
+	configInterpolations := configInterpolation{homedir, username, shell}
 	err = getInterpolatedConfig(&config, configInterpolations)
-	if err == nil {
-		config.ContainerName = config.ContainerName + "_" + strings.Replace(config.ImageName, ":", "_", -1)
+	if err != nil {
+		return config, sources, err
+	}
+	if config.Shell == "passwd" {
+		config.Shell = ""
+		config.ShellFallback = shellCandidates(config, username)
 	}
 
+	config.Profile = strings.Replace(config.ImageName, ":", "_", -1)
+	config.ContainerName = config.ContainerName + "_" + config.Profile
+
 	config.UserId = uid
 	config.GroupId = gid
 
-	return config, err
+	return config, sources, nil
+}
+
+// shellCandidates returns the shells to try, in order, for shell = passwd:
+// the user's shell from the passwd file followed by the fallback shells. The
+// first one which exists in the container is used. dockersh itself is
+// skipped, as that's the user's shell when it is used as a login shell.
+func shellCandidates(config Configuration, username string) []string {
+	shell, err := passwdShell(config.PasswdFile, username)
+	if err != nil {
+		logrus.Debugf("Could not look up the shell of %v: %v", username, err)
+		return config.ShellFallback
+	}
+	if shell == "" || filepath.Base(shell) == "dockersh" {
+		return config.ShellFallback
+	}
+	return append([]string{shell}, config.ShellFallback...)
 }
 
 type loadableFile string
@@ -115,12 +202,16 @@ func (fn loadableFile) Getcontents() ([]byte, error) {
 	return b, nil
 }
 
-func loadConfig(filename loadableFile, user string) (config Configuration, err error) {
+func loadConfig(filename loadableFile, user string, groups []string) (config Configuration, err error) {
 	bytes, err := filename.Getcontents()
 	if err != nil {
 		return config, err
 	}
-	return loadConfigFromString(bytes, user)
+	inicfg, err := parseConfig(string(filename), bytes)
+	if err != nil {
+		return config, err
+	}
+	return composeConfigs([]iniConfig{inicfg}, user, groups), nil
 }
 
 func mergeConfigs(old Configuration, new Configuration, blacklist bool) (ret Configuration) {
@@ -148,6 +239,9 @@ func mergeConfigs(old Configuration, new Configuration, blacklist bool) (ret Con
 	if (!blacklist || old.EnableUserMountTmp) && new.MountTmp == true {
 		old.MountTmp = true
 	}
+	if (!blacklist || old.EnableUserForwardAgent) && new.ForwardAgent == true {
+		old.ForwardAgent = true
+	}
 	if (!blacklist || old.EnableUserMountDockerSocket) && new.MountDockerSocket == true {
 		old.MountDockerSocket = true
 	}
@@ -169,30 +263,392 @@ func mergeConfigs(old Configuration, new Configuration, blacklist bool) (ret Con
 	if (!blacklist || old.EnableUserReverseForward) && len(new.ReverseForward) > 0 {
 		old.ReverseForward = new.ReverseForward
 	}
+	if !blacklist && new.Recycle != "" {
+		old.Recycle = new.Recycle
+	}
+	if !blacklist && new.Memory != "" {
+		old.Memory = new.Memory
+	}
+	if !blacklist && new.MemorySwap != "" {
+		old.MemorySwap = new.MemorySwap
+	}
+	if !blacklist && new.Cpus != "" {
+		old.Cpus = new.Cpus
+	}
+	if !blacklist && new.CpuShares != 0 {
+		old.CpuShares = new.CpuShares
+	}
+	if !blacklist && new.PidsLimit != 0 {
+		old.PidsLimit = new.PidsLimit
+	}
+	if !blacklist && new.BlkioWeight != 0 {
+		old.BlkioWeight = new.BlkioWeight
+	}
+	if !blacklist && new.UsernsMode != "" {
+		old.UsernsMode = new.UsernsMode
+	}
+	if !blacklist && new.SeccompProfile != "" {
+		old.SeccompProfile = new.SeccompProfile
+	}
+	if !blacklist && new.AppArmorProfile != "" {
+		old.AppArmorProfile = new.AppArmorProfile
+	}
+	if !blacklist && new.SelinuxLabel != "" {
+		old.SelinuxLabel = new.SelinuxLabel
+	}
+	if !blacklist && new.NoNewPrivileges == true {
+		old.NoNewPrivileges = true
+	}
+	if !blacklist && len(new.CapAdd) > 0 {
+		old.CapAdd = new.CapAdd
+	}
+	if !blacklist && len(new.CapDrop) > 0 {
+		old.CapDrop = new.CapDrop
+	}
+	if !blacklist && new.ReverseForwardRange != "" {
+		old.ReverseForwardRange = new.ReverseForwardRange
+	}
+	if !blacklist && len(new.AllowCommand) > 0 {
+		old.AllowCommand = new.AllowCommand
+	}
+	if !blacklist && len(new.DenyCommand) > 0 {
+		old.DenyCommand = new.DenyCommand
+	}
+	if !blacklist && new.SftpServer != "" {
+		old.SftpServer = new.SftpServer
+	}
+	if !blacklist && new.PasswdFile != "" {
+		old.PasswdFile = new.PasswdFile
+	}
+	if !blacklist && len(new.ShellFallback) > 0 {
+		old.ShellFallback = new.ShellFallback
+	}
+	if !blacklist && new.IdleTimeout != "" {
+		old.IdleTimeout = new.IdleTimeout
+	}
+	if !blacklist && new.Lifecycle != "" {
+		old.Lifecycle = new.Lifecycle
+	}
+	if !blacklist && new.AdminGroup != "" {
+		old.AdminGroup = new.AdminGroup
+	}
 	if !blacklist && new.EnableUserConfig == true {
 		old.EnableUserConfig = true
 	}
 	return old
 }
 
+// iniConfig is the layout of a configuration file, whatever its format.
+type iniConfig struct {
+	Dockersh Configuration
+	Group    map[string]*Configuration
+	User     map[string]*Configuration
+
+	// groupOrder lists the [group] sections in the order they are in the
+	// file, which the map loses.
+	groupOrder []string
+	filename   string
+}
+
 func loadConfigFromString(bytes []byte, user string) (config Configuration, err error) {
-	inicfg := struct {
-		Dockersh Configuration
-		User     map[string]*Configuration
-	}{}
+	inicfg := iniConfig{}
 	err = gcfg.ReadStringInto(&inicfg, string(bytes))
 	if err != nil {
 		return config, err
 	}
-	if inicfg.User[user] == nil {
-		return inicfg.Dockersh, nil
+	inicfg.groupOrder = groupSections(bytes)
+	return composeConfigs([]iniConfig{inicfg}, user, memberGroups(user)), nil
+}
+
+// parseConfig parses a configuration file, in the format given by its
+// extension.
+func parseConfig(filename string, bytes []byte) (inicfg iniConfig, err error) {
+	switch configFormat(filename) {
+	case "yaml":
+		return parseYamlConfig(filename, bytes)
+	case "toml":
+		return parseTomlConfig(filename, bytes)
+	}
+
+	inicfg.filename = filename
+	inicfg.groupOrder = groupSections(bytes)
+	err = gcfg.ReadStringInto(&inicfg, string(bytes))
+	if err != nil {
+		return inicfg, configError(filename, bytes, err)
+	}
+	return inicfg, nil
+}
+
+// groupSections returns the names of the [group] sections in a configuration
+// file, in order.
+func groupSections(bytes []byte) (groups []string) {
+	seen := map[string]bool{}
+	for _, l := range strings.Split(string(bytes), "\n") {
+		m := sectionHeader.FindStringSubmatch(strings.TrimSpace(l))
+		if m == nil || !strings.EqualFold(m[1], "group") || seen[m[2]] {
+			continue
+		}
+		seen[m[2]] = true
+		groups = append(groups, m[2])
+	}
+	return groups
+}
+
+// memberGroups returns the groups of user, or none if they can't be looked up.
+func memberGroups(user string) []string {
+	groups, err := userGroups(user)
+	if err != nil {
+		logrus.Debugf("Could not look up the groups of %v: %v", user, err)
+	}
+	return groups
+}
+
+// configLayer is a set of settings applied on top of the ones before it.
+type configLayer struct {
+	Source string // e.g. [dockersh] or [user "fred"]
+	File   string
+	Config Configuration
+}
+
+// userLayers returns the sections of the configuration files which apply to
+// the user, in the order they are applied: the [dockersh] sections, then the
+// [group] sections of the groups the user is in (in the order of the files,
+// and of the sections in each file), then the [user] sections.
+func userLayers(files []iniConfig, user string, groups []string) (layers []configLayer) {
+	member := map[string]bool{}
+	for _, g := range groups {
+		member[g] = true
+	}
+
+	for _, f := range files {
+		layers = append(layers, configLayer{"[dockersh]", f.filename, f.Dockersh})
+	}
+	for _, f := range files {
+		for _, g := range f.groupOrder {
+			if member[g] && f.Group[g] != nil {
+				layers = append(layers, configLayer{fmt.Sprintf("[group %q]", g), f.filename, *f.Group[g]})
+			}
+		}
+	}
+	for _, f := range files {
+		if f.User[user] != nil {
+			layers = append(layers, configLayer{fmt.Sprintf("[user %q]", user), f.filename, *f.User[user]})
+		}
+	}
+	return layers
+}
+
+// composeConfigs merges the layers of the user's settings onto the first one.
+func composeConfigs(files []iniConfig, user string, groups []string) (config Configuration) {
+	for i, l := range userLayers(files, user, groups) {
+		if i == 0 {
+			config = l.Config
+		} else {
+			config = mergeConfigs(config, l.Config, false)
+		}
+	}
+	return config
+}
+
+// settingSource records where the value of a setting came from, and the file
+// which tried to change it if it was refused because its enableuserxxx
+// setting was off.
+type settingSource struct {
+	Source  string
+	File    string
+	Refused string
+}
+
+// derivedSettings are Configuration fields which dockersh sets itself rather
+// than reading from the configuration files.
+var derivedSettings = map[string]bool{"Profile": true, "UserId": true, "GroupId": true}
+
+// applyLayer merges a layer into config, and records the source of the
+// settings it sets in sources.
+func applyLayer(config Configuration, layer configLayer, blacklist bool, sources map[string]settingSource) Configuration {
+	merged := mergeConfigs(config, layer.Config, blacklist)
+
+	t := reflect.TypeOf(layer.Config)
+	set := reflect.ValueOf(layer.Config)
+	got := reflect.ValueOf(merged)
+	for i := 0; i < t.NumField(); i++ {
+		if derivedSettings[t.Field(i).Name] || isZero(set.Field(i)) {
+			continue
+		}
+		name := strings.ToLower(t.Field(i).Name)
+		if reflect.DeepEqual(set.Field(i).Interface(), got.Field(i).Interface()) {
+			sources[name] = settingSource{Source: layer.Source, File: layer.File}
+		} else if blacklist {
+			src := sources[name]
+			src.Refused = layer.File
+			sources[name] = src
+		}
+	}
+
+	return merged
+}
+
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice:
+		return v.Len() == 0
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+const globalConfigFile = "/etc/dockersh"
+const configDropInDir = "/etc/dockersh.d"
+
+// altConfigExtensions are the extensions of configuration files in the YAML
+// and TOML formats, read alongside those in the ini format.
+var altConfigExtensions = []string{".yaml", ".yml", ".toml"}
+
+// globalConfigFiles returns the global configuration files which exist (at
+// least /etc/dockersh, if none do, so that its absence is reported) followed
+// by the drop-in fragments, in lexical order.
+func globalConfigFiles() ([]string, error) {
+	var files []string
+	for _, ext := range append([]string{""}, altConfigExtensions...) {
+		if _, err := os.Stat(globalConfigFile + ext); err == nil {
+			files = append(files, globalConfigFile+ext)
+		}
+	}
+	if len(files) == 0 {
+		files = []string{globalConfigFile}
+	}
+
+	var fragments []string
+	for _, ext := range append([]string{".conf"}, altConfigExtensions...) {
+		matches, err := filepath.Glob(filepath.Join(configDropInDir, "*"+ext))
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, matches...)
+	}
+	sort.Strings(fragments)
+	return append(files, fragments...), nil
+}
+
+// loadGlobalConfigFiles parses the global configuration file and the drop-in
+// fragments.
+func loadGlobalConfigFiles() (files []iniConfig, err error) {
+	filenames, err := globalConfigFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fn := range filenames {
+		bytes, err := loadableFile(fn).Getcontents()
+		if err != nil {
+			return nil, err
+		}
+		inicfg, err := parseConfig(fn, bytes)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, inicfg)
+	}
+
+	return files, nil
+}
+
+var settingPosition = regexp.MustCompile(`section "([^"]*)"(?:, subsection "([^"]*)")?(?:, variable "([^"]*)")?`)
+
+// configError adds the file name to a gcfg error, and for the errors gcfg
+// reports without a position (unknown sections and settings, bad values) the
+// line of the section or setting. gcfg reports an unknown section for every
+// line in it, so repeated errors are dropped. Like the yaml and toml errors,
+// the values are scrubbed from the messages.
+func configError(filename string, bytes []byte, err error) error {
+	var msgs []string
+	seen := map[string]bool{}
+	for _, msg := range strings.Split(strings.TrimSpace(err.Error()), "\n") {
+		msg = strings.TrimSpace(msg)
+		if msg == "" || msg == "warning:" || msg == "warnings:" {
+			continue
+		}
+		m := settingPosition.FindStringSubmatch(msg)
+		if m != nil {
+			key := configKey(m[1], m[2], m[3])
+			switch {
+			case strings.HasPrefix(msg, "can't store data") && m[3] == "":
+				msg = "unknown section " + key
+			case strings.HasPrefix(msg, "can't store data"):
+				msg = "unknown setting " + key
+			default:
+				msg = strings.TrimSuffix(strings.TrimSpace(strings.Replace(msg, m[0], "", 1)), " at")
+				msg = "invalid " + key + ": " + scrubConfigError(msg)
+			}
+		} else {
+			msg = scrubConfigError(msg)
+		}
+		// Syntax errors already start with line:column.
+		if msg[0] < '0' || msg[0] > '9' {
+			line := 0
+			if m != nil {
+				line = settingLine(bytes, m[1], m[2], m[3])
+			}
+			if line > 0 {
+				msg = fmt.Sprintf("%d: %s", line, msg)
+			} else {
+				msg = " " + msg
+			}
+		}
+		msg = filename + ":" + msg
+		if !seen[msg] {
+			seen[msg] = true
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(msgs) == 0 {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+// configKey returns the dotted name of a setting or section, as in the toml
+// errors.
+func configKey(section string, subsection string, variable string) string {
+	key := safeName(section)
+	if subsection != "" {
+		key += "." + safeName(subsection)
+	}
+	if variable != "" {
+		key += "." + safeName(variable)
+	}
+	return key
+}
+
+var sectionHeader = regexp.MustCompile(`^\[\s*(\S+)(?:\s+"((?:[^"\\]|\\.)*)")?\s*\]`)
+
+// settingLine returns the line number of a variable (or if variable is "" of
+// the section) in a configuration file, or 0 if it can't be found. gcfg
+// doesn't report the subsection of unknown sections, so if subsection is ""
+// any subsection matches.
+func settingLine(bytes []byte, section string, subsection string, variable string) int {
+	in := false
+	for i, l := range strings.Split(string(bytes), "\n") {
+		l = strings.TrimSpace(l)
+		if m := sectionHeader.FindStringSubmatch(l); m != nil {
+			in = strings.EqualFold(m[1], section) && (subsection == "" || m[2] == subsection)
+			if in && variable == "" {
+				return i + 1
+			}
+			continue
+		}
+		if !in || variable == "" {
+			continue
+		}
+		name := strings.TrimSpace(strings.SplitN(l, "=", 2)[0])
+		if strings.EqualFold(name, variable) {
+			return i + 1
+		}
 	}
-	return mergeConfigs(inicfg.Dockersh, *inicfg.User[user], false), nil
+	return 0
 }
 
 func tmplConfigVar(template string, v *configInterpolation) string {
-	shell := "/bin/bash"
-	r := strings.NewReplacer("%h", v.Home, "%u", v.User, "%s", shell) // Arguments are old, new ...
+	r := strings.NewReplacer("%h", v.Home, "%u", v.User, "%s", v.Shell) // Arguments are old, new ...
 	return r.Replace(template)
 }
 
@@ -212,3 +668,286 @@ func getInterpolatedConfig(config *Configuration, configInterpolations configInt
 
 	return nil
 }
+
+func validateConfig(config Configuration) error {
+	switch config.Recycle {
+	case "never", "idle", "always":
+	default:
+		return fmt.Errorf("invalid recycle policy %q, expected never, idle or always", config.Recycle)
+	}
+
+	switch config.Lifecycle {
+	case "persistent", "session":
+	default:
+		return fmt.Errorf("invalid lifecycle %q, expected persistent or session", config.Lifecycle)
+	}
+
+	switch config.UsernsMode {
+	case "", "default", "host", "private":
+	default:
+		return fmt.Errorf("invalid usernsmode %q, expected default, host or private", config.UsernsMode)
+	}
+
+	if _, err := resources(config); err != nil {
+		return err
+	}
+
+	if _, err := securityOpts(config); err != nil {
+		return err
+	}
+
+	if config.IdleTimeout != "" {
+		if d, err := time.ParseDuration(config.IdleTimeout); err != nil || d < 0 {
+			return fmt.Errorf("invalid idletimeout %q, expected a duration like 30m or 12h", config.IdleTimeout)
+		}
+	}
+
+	if err := validateReverseForwards(config); err != nil {
+		return err
+	}
+
+	for _, p := range append(config.AllowCommand, config.DenyCommand...) {
+		if _, err := compileCommandPattern(p); err != nil {
+			return fmt.Errorf("invalid command pattern %q: %v", p, err)
+		}
+	}
+
+	if _, err := normalizeCaps(config.CapAdd); err != nil {
+		return fmt.Errorf("invalid capadd: %v", err)
+	}
+	if _, err := normalizeCaps(config.CapDrop); err != nil {
+		return fmt.Errorf("invalid capdrop: %v", err)
+	}
+
+	return nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// parsePortforwardString parses a hostport:containerport reverse forward.
+func parsePortforwardString(s string) (hostPort int, containerPort int, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid reverseforward %q, expected hostport:containerport", s)
+	}
+	hostPort, err = parsePort(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid reverseforward %q: %v", s, err)
+	}
+	containerPort, err = parsePort(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid reverseforward %q: %v", s, err)
+	}
+	return hostPort, containerPort, nil
+}
+
+func validatePortforwardString(s string) error {
+	_, _, err := parsePortforwardString(s)
+	return err
+}
+
+// parsePortRange parses a low-high (or single) port range.
+func parsePortRange(s string) (lo int, hi int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	lo, err = parsePort(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	hi = lo
+	if len(parts) == 2 {
+		hi, err = parsePort(parts[1])
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if hi < lo {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return lo, hi, nil
+}
+
+// validateReverseForwards checks the reverse forwards' syntax, and that their
+// host ports are within the range the admin allows.
+func validateReverseForwards(config Configuration) error {
+	lo, hi := 1, 65535
+	if config.ReverseForwardRange != "" {
+		var err error
+		lo, hi, err = parsePortRange(config.ReverseForwardRange)
+		if err != nil {
+			return fmt.Errorf("invalid reverseforwardrange: %v", err)
+		}
+	}
+
+	for _, f := range config.ReverseForward {
+		hostPort, _, err := parsePortforwardString(f)
+		if err != nil {
+			return err
+		}
+		if hostPort < lo || hostPort > hi {
+			return fmt.Errorf("reverseforward %q: host port %d is outside the allowed range %d-%d", f, hostPort, lo, hi)
+		}
+	}
+
+	return nil
+}
+
+// compileCommandPattern compiles an allowcommand/denycommand regular
+// expression, which has to match the whole command.
+func compileCommandPattern(p string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + p + ")$")
+}
+
+// checkCommand checks a non-interactive command against the allowcommand and
+// denycommand patterns. With no allowcommand patterns every command which
+// isn't denied is allowed.
+func checkCommand(config Configuration, command string) error {
+	for _, p := range config.DenyCommand {
+		re, err := compileCommandPattern(p)
+		if err != nil {
+			return err
+		}
+		if re.MatchString(command) {
+			return fmt.Errorf("command %q is not allowed", command)
+		}
+	}
+
+	if len(config.AllowCommand) == 0 {
+		return nil
+	}
+	for _, p := range config.AllowCommand {
+		re, err := compileCommandPattern(p)
+		if err != nil {
+			return err
+		}
+		if re.MatchString(command) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("command %q is not allowed", command)
+}
+
+var linuxCapabilities = map[string]bool{
+	"AUDIT_CONTROL": true, "AUDIT_READ": true, "AUDIT_WRITE": true, "BLOCK_SUSPEND": true,
+	"BPF": true, "CHECKPOINT_RESTORE": true, "CHOWN": true, "DAC_OVERRIDE": true,
+	"DAC_READ_SEARCH": true, "FOWNER": true, "FSETID": true, "IPC_LOCK": true,
+	"IPC_OWNER": true, "KILL": true, "LEASE": true, "LINUX_IMMUTABLE": true,
+	"MAC_ADMIN": true, "MAC_OVERRIDE": true, "MKNOD": true, "NET_ADMIN": true,
+	"NET_BIND_SERVICE": true, "NET_BROADCAST": true, "NET_RAW": true, "PERFMON": true,
+	"SETFCAP": true, "SETGID": true, "SETPCAP": true, "SETUID": true,
+	"SYS_ADMIN": true, "SYS_BOOT": true, "SYS_CHROOT": true, "SYS_MODULE": true,
+	"SYS_NICE": true, "SYS_PACCT": true, "SYS_PTRACE": true, "SYS_RAWIO": true,
+	"SYS_RESOURCE": true, "SYS_TIME": true, "SYS_TTY_CONFIG": true, "SYSLOG": true,
+	"WAKE_ALARM": true,
+}
+
+// normalizeCaps upper cases capability names and strips any CAP_ prefix,
+// rejecting names which aren't Linux capabilities (or ALL).
+func normalizeCaps(caps []string) ([]string, error) {
+	var ret []string
+	for _, c := range caps {
+		n := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(c)), "CAP_")
+		if n != "ALL" && !linuxCapabilities[n] {
+			return nil, fmt.Errorf("unknown capability %q", c)
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+// securityOpts converts the security settings into docker's security options.
+// The seccomp profile is read from a file, as the daemon wants the profile
+// itself rather than a path.
+func securityOpts(config Configuration) ([]string, error) {
+	var opts []string
+
+	if config.SeccompProfile == "unconfined" {
+		opts = append(opts, "seccomp=unconfined")
+	} else if config.SeccompProfile != "" {
+		b, err := loadableFile(config.SeccompProfile).Getcontents()
+		if err != nil {
+			return nil, fmt.Errorf("could not read seccompprofile: %v", err)
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, b); err != nil {
+			return nil, fmt.Errorf("seccompprofile %s is not valid JSON: %v", config.SeccompProfile, err)
+		}
+		opts = append(opts, "seccomp="+compact.String())
+	}
+
+	if config.AppArmorProfile != "" {
+		opts = append(opts, "apparmor="+config.AppArmorProfile)
+	}
+
+	if config.SelinuxLabel != "" {
+		opts = append(opts, "label="+config.SelinuxLabel)
+	}
+
+	if config.NoNewPrivileges {
+		opts = append(opts, "no-new-privileges")
+	}
+
+	return opts, nil
+}
+
+// resources converts the resource limit settings into docker's
+// representation, validating them on the way.
+func resources(config Configuration) (r container.Resources, err error) {
+	if config.Memory != "" {
+		r.Memory, err = units.RAMInBytes(config.Memory)
+		if err != nil {
+			return r, fmt.Errorf("invalid memory %q: %v", config.Memory, err)
+		}
+		if r.Memory <= 0 {
+			return r, fmt.Errorf("invalid memory %q: must be positive", config.Memory)
+		}
+	}
+
+	if config.MemorySwap == "-1" {
+		r.MemorySwap = -1
+	} else if config.MemorySwap != "" {
+		r.MemorySwap, err = units.RAMInBytes(config.MemorySwap)
+		if err != nil {
+			return r, fmt.Errorf("invalid memoryswap %q: %v", config.MemorySwap, err)
+		}
+		if r.Memory == 0 {
+			return r, fmt.Errorf("memoryswap requires memory to be set")
+		}
+		if r.MemorySwap < r.Memory {
+			return r, fmt.Errorf("invalid memoryswap %q: must be at least memory (%s) or -1", config.MemorySwap, config.Memory)
+		}
+	}
+
+	if config.Cpus != "" {
+		cpus, err := strconv.ParseFloat(config.Cpus, 64)
+		if err != nil || cpus <= 0 {
+			return r, fmt.Errorf("invalid cpus %q: must be a positive number", config.Cpus)
+		}
+		r.NanoCPUs = int64(cpus * 1e9)
+	}
+
+	if config.CpuShares < 0 {
+		return r, fmt.Errorf("invalid cpushares %d: must be positive", config.CpuShares)
+	}
+	r.CPUShares = config.CpuShares
+
+	if config.PidsLimit < -1 {
+		return r, fmt.Errorf("invalid pidslimit %d: must be positive or -1 for unlimited", config.PidsLimit)
+	}
+	if config.PidsLimit != 0 {
+		r.PidsLimit = &config.PidsLimit
+	}
+
+	if config.BlkioWeight != 0 && (config.BlkioWeight < 10 || config.BlkioWeight > 1000) {
+		return r, fmt.Errorf("invalid blkioweight %d: must be between 10 and 1000", config.BlkioWeight)
+	}
+	r.BlkioWeight = config.BlkioWeight
+
+	return r, nil
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -10,7 +13,7 @@ func Test_loadAllConfig_1(t *testing.T) {
 		t.Log("No /etc/dockersh, skipping test")
 		return
 	}
-	_, err := loadAllConfig("notexist", "/notexist")
+	_, err := loadAllConfig()
 	if err != nil {
 		t.Errorf("Got error %v", err)
 	}
@@ -207,3 +210,322 @@ imagename = testimage
 		t.Errorf("Expected ImageName testimage got %s", c.ImageName)
 	}
 }
+
+func Test_validateConfig_recycle(t *testing.T) {
+	c := defaultConfig
+	if err := validateConfig(c); err != nil {
+		t.Errorf("Got error %v for default config", err)
+	}
+	c.Recycle = "sometimes"
+	if err := validateConfig(c); err == nil {
+		t.Error("No error for invalid recycle policy")
+	}
+}
+
+func Test_IniConfig_resources(t *testing.T) {
+	c, err := loadConfigFromString([]byte(`[dockersh]
+memory = 512m
+cpus = 1.5
+pidslimit = 100
+
+[user "fred"]
+memory = 1g
+blkioweight = 500
+`), "fred")
+	if err != nil {
+		t.Error(err)
+	}
+	r, err := resources(c)
+	if err != nil {
+		t.Errorf("Got error %v", err)
+	}
+	if r.Memory != 1024*1024*1024 {
+		t.Errorf("Expected memory 1g got %v", r.Memory)
+	}
+	if r.NanoCPUs != 1500000000 {
+		t.Errorf("Expected 1.5 cpus got %v nanocpus", r.NanoCPUs)
+	}
+	if r.PidsLimit == nil || *r.PidsLimit != 100 {
+		t.Errorf("Expected pidslimit 100 got %v", r.PidsLimit)
+	}
+	if r.BlkioWeight != 500 {
+		t.Errorf("Expected blkioweight 500 got %v", r.BlkioWeight)
+	}
+}
+
+func Test_IniConfig_resources_blacklist(t *testing.T) {
+	c := Configuration{Memory: "32m", EnableUserConfig: true}
+	n, err := loadConfigFromString([]byte(`[dockersh]
+memory = 8g`), "fred")
+	if err != nil {
+		t.Error(err)
+	}
+	c = mergeConfigs(c, n, true)
+	if c.Memory != "32m" {
+		t.Errorf("User config changed memory to %s", c.Memory)
+	}
+}
+
+func Test_resources_invalid(t *testing.T) {
+	for _, c := range []Configuration{
+		{Memory: "lots"},
+		{Memory: "32m", MemorySwap: "16m"},
+		{MemorySwap: "1g"},
+		{Cpus: "0"},
+		{Cpus: "two"},
+		{PidsLimit: -5},
+		{BlkioWeight: 5},
+	} {
+		if _, err := resources(c); err == nil {
+			t.Errorf("No error for %+v", c)
+		}
+	}
+}
+
+func Test_securityOpts_1(t *testing.T) {
+	f, err := ioutil.TempFile("", "seccomp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("{\n  \"defaultAction\": \"SCMP_ACT_ERRNO\"\n}\n")
+	f.Close()
+
+	c := Configuration{SeccompProfile: f.Name(), AppArmorProfile: "dockersh", SelinuxLabel: "level:s0:c100,c200", NoNewPrivileges: true}
+	opts, err := securityOpts(c)
+	if err != nil {
+		t.Errorf("Got error %v", err)
+	}
+	exp := []string{`seccomp={"defaultAction":"SCMP_ACT_ERRNO"}`, "apparmor=dockersh", "label=level:s0:c100,c200", "no-new-privileges"}
+	if !reflect.DeepEqual(opts, exp) {
+		t.Errorf("Expected %v got %v", exp, opts)
+	}
+}
+
+func Test_securityOpts_2(t *testing.T) {
+	f, err := ioutil.TempFile("", "seccomp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("{not json")
+	f.Close()
+
+	_, err = securityOpts(Configuration{SeccompProfile: f.Name()})
+	if err == nil {
+		t.Error("No error for invalid seccomp profile")
+	}
+}
+
+func Test_IniConfig_security_blacklist(t *testing.T) {
+	c, err := loadConfigFromString([]byte(`[dockersh]
+seccompprofile = /etc/dockersh-seccomp.json
+enableuserconfig
+`), "fred")
+	n, err := loadConfigFromString([]byte(`[dockersh]
+seccompprofile = unconfined
+apparmorprofile = unconfined`), "fred")
+	if err != nil {
+		t.Error(err)
+	}
+	c = mergeConfigs(c, n, true)
+	if c.SeccompProfile != "/etc/dockersh-seccomp.json" || c.AppArmorProfile != "" {
+		t.Errorf("User config changed security settings: %+v", c)
+	}
+}
+
+func Test_normalizeCaps_1(t *testing.T) {
+	caps, err := normalizeCaps([]string{"all", "CAP_NET_BIND_SERVICE", "sys_ptrace"})
+	if err != nil {
+		t.Errorf("Got error %v", err)
+	}
+	exp := []string{"ALL", "NET_BIND_SERVICE", "SYS_PTRACE"}
+	if !reflect.DeepEqual(caps, exp) {
+		t.Errorf("Expected %v got %v", exp, caps)
+	}
+	if _, err := normalizeCaps([]string{"NET_BIND"}); err == nil {
+		t.Error("No error for unknown capability")
+	}
+}
+
+func Test_IniConfig_caps(t *testing.T) {
+	c, err := loadConfigFromString([]byte(`[dockersh]
+capdrop = ALL
+enableuserconfig
+
+[user "fred"]
+capadd = NET_BIND_SERVICE
+`), "fred")
+	if err != nil {
+		t.Error(err)
+	}
+	c = mergeConfigs(defaultConfig, c, false)
+	if !reflect.DeepEqual(c.CapDrop, []string{"ALL"}) || !reflect.DeepEqual(c.CapAdd, []string{"NET_BIND_SERVICE"}) {
+		t.Errorf("Unexpected caps add %v drop %v", c.CapAdd, c.CapDrop)
+	}
+	n, err := loadConfigFromString([]byte(`[dockersh]
+capadd = SYS_ADMIN
+capdrop = MKNOD`), "fred")
+	if err != nil {
+		t.Error(err)
+	}
+	c = mergeConfigs(c, n, true)
+	if !reflect.DeepEqual(c.CapDrop, []string{"ALL"}) || !reflect.DeepEqual(c.CapAdd, []string{"NET_BIND_SERVICE"}) {
+		t.Errorf("User config changed caps to add %v drop %v", c.CapAdd, c.CapDrop)
+	}
+}
+
+func Test_validateReverseForwards_1(t *testing.T) {
+	c := Configuration{ReverseForward: []string{"8080:80"}, ReverseForwardRange: "8000-8999"}
+	if err := validateReverseForwards(c); err != nil {
+		t.Errorf("Got error %v", err)
+	}
+	c.ReverseForward = []string{"9090:80"}
+	if err := validateReverseForwards(c); err == nil {
+		t.Error("No error for host port outside the allowed range")
+	}
+	c.ReverseForwardRange = "9000-8000"
+	if err := validateReverseForwards(c); err == nil {
+		t.Error("No error for invalid range")
+	}
+	c = Configuration{ReverseForward: []string{"80"}}
+	if err := validateReverseForwards(c); err == nil {
+		t.Error("No error for invalid reverseforward")
+	}
+}
+
+func Test_checkCommand_1(t *testing.T) {
+	c, err := loadConfigFromString([]byte(`[dockersh]
+denycommand = .*rm -rf /.*
+
+[user "fred"]
+allowcommand = git-(upload|receive)-pack '.*'
+allowcommand = make( .*)?
+`), "fred")
+	if err != nil {
+		t.Error(err)
+	}
+	for _, cmd := range []string{"git-upload-pack 'repo.git'", "make", "make test"} {
+		if err := checkCommand(c, cmd); err != nil {
+			t.Errorf("Got error %v for %s", err, cmd)
+		}
+	}
+	for _, cmd := range []string{"bash", "make test; rm -rf /", "xmake"} {
+		if err := checkCommand(c, cmd); err == nil {
+			t.Errorf("No error for %s", cmd)
+		}
+	}
+}
+
+func Test_shellCandidates_1(t *testing.T) {
+	f, err := ioutil.TempFile("", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("fred:x:1000:1000::/home/fred:/bin/zsh\nbill:x:1001:1001::/home/bill:/usr/local/bin/dockersh\n")
+	f.Close()
+
+	c := defaultConfig
+	c.PasswdFile = f.Name()
+	exp := []string{"/bin/zsh", "/bin/bash", "/bin/ash", "/bin/sh"}
+	if s := shellCandidates(c, "fred"); !reflect.DeepEqual(s, exp) {
+		t.Errorf("Expected %v got %v", exp, s)
+	}
+	if s := shellCandidates(c, "bill"); !reflect.DeepEqual(s, defaultConfig.ShellFallback) {
+		t.Errorf("Expected %v got %v", defaultConfig.ShellFallback, s)
+	}
+}
+
+func Test_composeConfigs_1(t *testing.T) {
+	main, err := parseConfig("main", []byte("[dockersh]\nimagename = busybox\nshell = /bin/sh\n[user \"fred\"]\nshell = /bin/zsh\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fragment, err := parseConfig("fragment", []byte("[dockersh]\nimagename = ubuntu\nshell = /bin/bash\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := composeConfigs([]iniConfig{main, fragment}, "fred", nil)
+	if c.ImageName != "ubuntu" {
+		t.Errorf("Expected imagename ubuntu got %s", c.ImageName)
+	}
+	if c.Shell != "/bin/zsh" {
+		t.Errorf("Expected shell /bin/zsh got %s", c.Shell)
+	}
+}
+
+func Test_parseConfig_errors(t *testing.T) {
+	_, err := parseConfig("/etc/dockersh.d/10-foo.conf", []byte("[dockersh]\nimagename = busybox\nimagname = ubuntu\n"))
+	if err == nil || !strings.Contains(err.Error(), "/etc/dockersh.d/10-foo.conf:3: unknown setting") {
+		t.Errorf("Unexpected error %v", err)
+	}
+	_, err = parseConfig("/etc/dockersh.d/10-foo.conf", []byte("[dockersh]\nmounthome = maybe\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "/etc/dockersh.d/10-foo.conf:") {
+		t.Errorf("Unexpected error %v", err)
+	}
+	_, err = parseConfig("/etc/dockersh.d/10-foo.conf", []byte("[dockersh]\nimagename = busybox\n[usr \"fred\"]\nshell = /bin/sh\nimagename = ubuntu\n"))
+	if err == nil || strings.Count(err.Error(), "\n") != 0 || !strings.HasPrefix(err.Error(), "/etc/dockersh.d/10-foo.conf:3: unknown section") {
+		t.Errorf("Unexpected error %v", err)
+	}
+	_, err = parseConfig("/etc/shadow", []byte("[dockersh]\npidslimit = s3cr3t\n"))
+	if err == nil || err.Error() != `/etc/shadow:2: invalid dockersh.pidslimit: failed to parse "..." as int64: expected integer` {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func Test_composeConfigs_groups(t *testing.T) {
+	main, err := parseConfig("main", []byte(`[dockersh]
+imagename = busybox
+[group "developers"]
+imagename = golang
+shell = /bin/bash
+[group "ops"]
+imagename = ubuntu
+[user "fred"]
+shell = /bin/zsh
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := composeConfigs([]iniConfig{main}, "fred", []string{"ops", "developers"})
+	if c.ImageName != "ubuntu" {
+		t.Errorf("Expected imagename ubuntu got %s", c.ImageName)
+	}
+	if c.Shell != "/bin/zsh" {
+		t.Errorf("Expected shell /bin/zsh got %s", c.Shell)
+	}
+	c = composeConfigs([]iniConfig{main}, "bill", []string{"developers"})
+	if c.ImageName != "golang" || c.Shell != "/bin/bash" {
+		t.Errorf("Expected golang and /bin/bash got %s and %s", c.ImageName, c.Shell)
+	}
+	c = composeConfigs([]iniConfig{main}, "bill", nil)
+	if c.ImageName != "busybox" {
+		t.Errorf("Expected imagename busybox got %s", c.ImageName)
+	}
+}
+
+func Test_applyLayer_1(t *testing.T) {
+	sources := map[string]settingSource{}
+	c := applyLayer(Configuration{}, configLayer{Source: "default", Config: defaultConfig}, false, sources)
+	c = applyLayer(c, configLayer{"[dockersh]", "/etc/dockersh", Configuration{ImageName: "ubuntu", EnableUserConfig: true}}, false, sources)
+	c = applyLayer(c, configLayer{"~/.dockersh", "/home/fred/.dockersh", Configuration{ImageName: "evil", Shell: "/bin/zsh"}}, true, sources)
+
+	if c.ImageName != "ubuntu" || c.Shell != defaultConfig.Shell {
+		t.Errorf("Expected ubuntu and %s got %s and %s", defaultConfig.Shell, c.ImageName, c.Shell)
+	}
+	exp := map[string]settingSource{
+		"imagename":        {"[dockersh]", "/etc/dockersh", "/home/fred/.dockersh"},
+		"shell":            {"default", "", "/home/fred/.dockersh"},
+		"dockersocket":     {"default", "", ""},
+		"enableuserconfig": {"[dockersh]", "/etc/dockersh", ""},
+	}
+	for name, src := range exp {
+		if sources[name] != src {
+			t.Errorf("Expected %s from %+v got %+v", name, src, sources[name])
+		}
+	}
+	if _, ok := sources["memory"]; ok {
+		t.Errorf("Unexpected source for memory: %+v", sources["memory"])
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/distribution/reference"
+)
+
+func configCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: dockersh config show [--user name] [--json]\n")
+		fmt.Fprintf(os.Stderr, "       dockersh config check [file]\n")
+		return 2
+	}
+
+	switch args[0] {
+	case "show":
+		return configShowCommand(args[1:])
+	case "check":
+		return configCheckCommand(args[1:])
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown config command: %s\n", args[0])
+	return 2
+}
+
+type settingInfo struct {
+	Setting string      `json:"setting"`
+	Value   interface{} `json:"value"`
+	Source  string      `json:"source"`
+	File    string      `json:"file,omitempty"`
+	Refused string      `json:"refused,omitempty"`
+	// The shells tried, in order, for shell = passwd
+	Candidates []string `json:"candidates,omitempty"`
+}
+
+func configShowCommand(args []string) int {
+	flags := flag.NewFlagSet("config show", flag.ExitOnError)
+	username := flags.String("user", "", "Show the configuration of this user. Default: the current user")
+	jsonOutput := flags.Bool("json", false, "Output JSON")
+	flags.Parse(args)
+
+	u, err := user.Current()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not get current user: %v\n", err)
+		return 1
+	}
+	if *username != "" && *username != u.Username {
+		// Other users' configuration is for admins only
+		if err := requireAdmin(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		u, err = user.Lookup(*username)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not look up user %s: %v\n", *username, err)
+			return 1
+		}
+	}
+
+	name, homedir, uid, gid, err := getUser(u)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not get user: %v\n", err)
+		return 1
+	}
+	config, sources, err := loadUserConfig(name, homedir, uid, gid)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load config: %v\n", err)
+		return 1
+	}
+
+	infos := settingInfos(config, sources)
+	for i := range infos {
+		if infos[i].Setting == "shell" && config.Shell == "" {
+			infos[i].Value = "passwd"
+			infos[i].Candidates = config.ShellFallback
+		}
+	}
+
+	// An invalid configuration is shown too, to help find the culprit
+	invalid := validateConfig(config)
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(infos); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write JSON: %v\n", err)
+			return 1
+		}
+	} else {
+		printSettingInfos(infos)
+	}
+
+	if invalid != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v\n", invalid)
+		return 1
+	}
+	return 0
+}
+
+func printSettingInfos(infos []settingInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SETTING\tVALUE\tSOURCE")
+	for _, i := range infos {
+		source := i.Source
+		if i.File != "" {
+			source += " " + i.File
+		}
+		if i.Refused != "" {
+			source += " (refused from " + i.Refused + ")"
+		}
+		value := formatSetting(i.Value)
+		if len(i.Candidates) > 0 {
+			value += " (" + formatSetting(i.Candidates) + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", i.Setting, value, source)
+	}
+	w.Flush()
+}
+
+// settingInfos lists the settings of config, in the order of the
+// Configuration struct, with where their values came from.
+func settingInfos(config Configuration, sources map[string]settingSource) []settingInfo {
+	var infos []settingInfo
+
+	t := reflect.TypeOf(config)
+	v := reflect.ValueOf(config)
+	for i := 0; i < t.NumField(); i++ {
+		if derivedSettings[t.Field(i).Name] {
+			continue
+		}
+		name := strings.ToLower(t.Field(i).Name)
+		src, ok := sources[name]
+		if !ok || src.Source == "" {
+			src.Source = "default"
+		}
+		infos = append(infos, settingInfo{
+			Setting: name,
+			Value:   v.Field(i).Interface(),
+			Source:  src.Source,
+			File:    src.File,
+			Refused: src.Refused,
+		})
+	}
+
+	return infos
+}
+
+func formatSetting(value interface{}) string {
+	if l, ok := value.([]string); ok {
+		return strings.Join(l, ", ")
+	}
+	return fmt.Sprint(value)
+}
+
+func configCheckCommand(args []string) int {
+	flags := flag.NewFlagSet("config check", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: dockersh config check [file]\n")
+		fmt.Fprintf(os.Stderr, "Checks the given config files, or %s and the fragments in %s\n", globalConfigFile, configDropInDir)
+	}
+	flags.Parse(args)
+
+	var filenames []string
+	if flags.NArg() > 0 {
+		// dockersh runs as root, so only admins may have it read any file
+		if err := requireAdmin(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		filenames = flags.Args()
+	} else {
+		var err error
+		filenames, err = globalConfigFiles()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not list config files: %v\n", err)
+			return 1
+		}
+	}
+
+	errs, warnings := checkConfigFiles(filenames)
+	for _, w := range warnings {
+		fmt.Printf("warning: %s\n", w)
+	}
+	for _, e := range errs {
+		fmt.Printf("error: %s\n", e)
+	}
+	if len(errs) > 0 {
+		fmt.Printf("%d errors, %d warnings\n", len(errs), len(warnings))
+		return 1
+	}
+	fmt.Printf("OK, %d warnings\n", len(warnings))
+	return 0
+}
+
+// checkConfigFiles parses the config files and checks the configuration
+// each of their sections results in (on top of the defaults and the
+// [dockersh] sections), returning the errors and warnings found.
+func checkConfigFiles(filenames []string) (errs []string, warnings []string) {
+	var files []iniConfig
+	for _, fn := range filenames {
+		bytes, err := loadableFile(fn).Getcontents()
+		if err == nil {
+			var inicfg iniConfig
+			inicfg, err = parseConfig(fn, bytes)
+			files = append(files, inicfg)
+		}
+		if err != nil {
+			errs = append(errs, strings.Split(err.Error(), "\n")...)
+		}
+	}
+
+	reported := map[string]bool{}
+	report := func(where string, section Configuration, c Configuration) {
+		for _, e := range checkConfig(c) {
+			if !reported[e] {
+				reported[e] = true
+				errs = append(errs, where+": "+e)
+			}
+		}
+		// mergeConfigs doesn't carry the enableuserxxx settings over, so
+		// warn about the ones the section sets
+		section.EnableUserConfig = c.EnableUserConfig
+		for _, w := range configWarnings(section) {
+			if !reported[w] {
+				reported[w] = true
+				warnings = append(warnings, where+": "+w)
+			}
+		}
+	}
+
+	base := defaultConfig
+	for _, f := range files {
+		base = mergeConfigs(base, f.Dockersh, false)
+		report(f.filename+": [dockersh]", f.Dockersh, base)
+	}
+	for _, f := range files {
+		for _, g := range f.groupOrder {
+			if f.Group[g] != nil {
+				report(fmt.Sprintf("%s: [group %q]", f.filename, g), *f.Group[g], mergeConfigs(base, *f.Group[g], false))
+			}
+		}
+		var users []string
+		for u := range f.User {
+			users = append(users, u)
+		}
+		sort.Strings(users)
+		for _, u := range users {
+			report(fmt.Sprintf("%s: [user %q]", f.filename, u), *f.User[u], mergeConfigs(base, *f.User[u], false))
+		}
+	}
+
+	return errs, warnings
+}
+
+// checkConfig returns the problems with a configuration, interpolated for
+// a placeholder user.
+func checkConfig(c Configuration) (errs []string) {
+	c.Env = append([]string(nil), c.Env...)
+	getInterpolatedConfig(&c, configInterpolation{"/home/user", "user", "/bin/sh"})
+
+	if err := validateConfig(c); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if _, err := reference.ParseNormalizedNamed(c.ImageName); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid imagename %q: %v", c.ImageName, err))
+	}
+
+	for _, e := range c.Env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || strings.ContainsAny(kv[0], " \t") {
+			errs = append(errs, fmt.Sprintf("invalid env %q, expected KEY=VALUE", e))
+		}
+	}
+
+	paths := map[string]string{
+		"mounthomefrom": c.MountHomeFrom,
+		"mounthometo":   c.MountHomeTo,
+		"usercwd":       c.UserCwd,
+		"dockersocket":  c.DockerSocket,
+		"passwdfile":    c.PasswdFile,
+		"sftpserver":    c.SftpServer,
+	}
+	if c.Shell != "passwd" {
+		paths["shell"] = c.Shell
+	}
+	if c.SeccompProfile != "unconfined" {
+		paths["seccompprofile"] = c.SeccompProfile
+	}
+	for _, s := range c.ShellFallback {
+		if !filepath.IsAbs(s) {
+			errs = append(errs, fmt.Sprintf("invalid shellfallback %q, expected an absolute path", s))
+		}
+	}
+	for _, name := range sortedKeys(paths) {
+		if p := paths[name]; p != "" && !filepath.IsAbs(p) {
+			errs = append(errs, fmt.Sprintf("invalid %s %q, expected an absolute path", name, p))
+		}
+	}
+
+	return errs
+}
+
+// configWarnings returns the settings of a configuration which are allowed
+// but probably a mistake, as they let users escape the container or
+// interfere with other users.
+func configWarnings(c Configuration) (warnings []string) {
+	if c.MountDockerSocket {
+		warnings = append(warnings, "mountdockersocket gives the user root access to the host through the docker daemon")
+	}
+	if !c.EnableUserConfig {
+		return warnings
+	}
+	if c.EnableUserMountDockerSocket {
+		warnings = append(warnings, "enableusermountdockersocket lets users give themselves root access to the host through the docker daemon")
+	}
+	if c.EnableUserDockerSocket {
+		warnings = append(warnings, "enableuserdockersocket lets users choose which host socket is mounted in their container")
+	}
+	if c.EnableUserMountHomeFrom {
+		warnings = append(warnings, "enableusermounthomefrom lets users mount any host directory they choose in their container")
+	}
+	if c.EnableUserContainerName {
+		warnings = append(warnings, "enableusercontainername lets users choose a container name which clashes with another user's")
+	}
+	return warnings
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_checkConfigFiles_1(t *testing.T) {
+	f, err := ioutil.TempFile("", "dockersh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[dockersh]
+imagename = busybox
+env = FOO=bar
+enableuserconfig
+enableusercontainername
+[group "developers"]
+env = FOO
+[user "fred"]
+capadd = FLY
+mounthomefrom = relative
+`)
+	f.Close()
+
+	errs, warnings := checkConfigFiles([]string{f.Name()})
+	exp := []string{
+		`[group "developers"]: invalid env "FOO", expected KEY=VALUE`,
+		`[user "fred"]: invalid capadd: unknown capability "FLY"`,
+		`[user "fred"]: invalid mounthomefrom "relative", expected an absolute path`,
+	}
+	if len(errs) != len(exp) {
+		t.Fatalf("Expected %d errors got %v", len(exp), errs)
+	}
+	for i, e := range exp {
+		if !strings.HasSuffix(errs[i], e) {
+			t.Errorf("Expected error %s got %s", e, errs[i])
+		}
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "enableusercontainername") {
+		t.Errorf("Unexpected warnings %v", warnings)
+	}
+}
+
+func Test_checkConfig_1(t *testing.T) {
+	if errs := checkConfig(defaultConfig); len(errs) != 0 {
+		t.Errorf("Unexpected errors for the default config: %v", errs)
+	}
+	c := defaultConfig
+	c.ImageName = "Not An Image"
+	if errs := checkConfig(c); len(errs) != 1 {
+		t.Errorf("Expected an error for imagename got %v", errs)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Configuration files can also be written in YAML or TOML, chosen by their
+// extension. They have the same layout as the ini format: a dockersh table,
+// and group and user tables keyed by name, e.g.
+//
+//	dockersh:
+//	  imagename: busybox
+//	  env: [FOO=bar]
+//	user:
+//	  fred:
+//	    shell: /bin/zsh
+//
+// and use the same (lower case) setting names.
+
+func configFormat(filename string) string {
+	switch filepath.Ext(filename) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "ini"
+}
+
+func parseYamlConfig(filename string, bytes []byte) (inicfg iniConfig, err error) {
+	inicfg.filename = filename
+	if err := yaml.UnmarshalStrict(bytes, &inicfg); err != nil {
+		return inicfg, yamlError(filename, err)
+	}
+
+	// The group order is lost in the map, so get it from the raw document
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(bytes, &doc); err != nil {
+		return inicfg, yamlError(filename, err)
+	}
+	for _, section := range doc {
+		if section.Key != "group" {
+			continue
+		}
+		groups, _ := section.Value.(yaml.MapSlice)
+		for _, g := range groups {
+			inicfg.groupOrder = append(inicfg.groupOrder, fmt.Sprint(g.Key))
+		}
+	}
+
+	return inicfg, nil
+}
+
+var yamlErrorLine = regexp.MustCompile(`^line (\d+): `)
+var yamlUnknownField = regexp.MustCompile(`^field (.*) not found in type \S+$`)
+
+// yamlError adds the file name to a yaml error, in the same file:line: form
+// as the errors for ini files.
+func yamlError(filename string, err error) error {
+	var msgs []string
+	for _, msg := range strings.Split(err.Error(), "\n") {
+		msg = strings.TrimSpace(strings.TrimPrefix(msg, "yaml: "))
+		if msg == "" || msg == "unmarshal errors:" {
+			continue
+		}
+		msg = scrubConfigError(msg)
+		if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+			msg = msg[len(m[0]):]
+			if f := yamlUnknownField.FindStringSubmatch(msg); f != nil {
+				msg = "unknown setting " + safeName(f[1])
+			}
+			msgs = append(msgs, fmt.Sprintf("%s:%s: %s", filename, m[1], msg))
+		} else {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", filename, msg))
+		}
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+func parseTomlConfig(filename string, bytes []byte) (inicfg iniConfig, err error) {
+	inicfg.filename = filename
+	md, err := toml.Decode(string(bytes), &inicfg)
+	if err != nil {
+		return inicfg, fmt.Errorf("%s: %s", filename, scrubConfigError(err.Error()))
+	}
+
+	var unknown []string
+	for _, k := range md.Undecoded() {
+		unknown = append(unknown, fmt.Sprintf("%s: unknown setting %s", filename, safeName(k.String())))
+	}
+	if len(unknown) > 0 {
+		return inicfg, errors.New(strings.Join(unknown, "\n"))
+	}
+
+	for _, k := range md.Keys() {
+		if len(k) == 2 && k[0] == "group" {
+			inicfg.groupOrder = append(inicfg.groupOrder, k[1])
+		}
+	}
+
+	return inicfg, nil
+}
+
+// Config files are read as root, so the errors about them mustn't show their
+// contents, in case they are some other file (e.g. a symlink to /etc/shadow).
+// Only names which could be setting names are kept.
+
+var settingName = regexp.MustCompile(`^[A-Za-z0-9_.-]{0,64}$`)
+
+var quoted = regexp.MustCompile("`[^`]*`|'[^']*'|\"[^\"]*\"")
+
+func safeName(name string) string {
+	if settingName.MatchString(name) {
+		return name
+	}
+	return "(invalid name)"
+}
+
+// scrubConfigError removes the quoted values from a decoding error, other
+// than single characters (which are syntax).
+func scrubConfigError(msg string) string {
+	return quoted.ReplaceAllStringFunc(msg, func(q string) string {
+		if len(q) <= 3 {
+			return q
+		}
+		return q[:1] + "..." + q[len(q)-1:]
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_parseConfig_yaml(t *testing.T) {
+	inicfg, err := parseConfig("/etc/dockersh.yaml", []byte(`dockersh:
+  imagename: busybox
+  mounthome: true
+  env: [FOO=bar, BAZ=qux]
+group:
+  ops:
+    imagename: ubuntu
+  developers:
+    imagename: golang
+user:
+  fred:
+    shell: /bin/zsh
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inicfg.groupOrder, []string{"ops", "developers"}) {
+		t.Errorf("Unexpected group order %v", inicfg.groupOrder)
+	}
+	c := composeConfigs([]iniConfig{inicfg}, "fred", []string{"developers", "ops"})
+	if c.ImageName != "golang" || c.Shell != "/bin/zsh" || !c.MountHome {
+		t.Errorf("Unexpected config %+v", c)
+	}
+	if !reflect.DeepEqual(c.Env, []string{"FOO=bar", "BAZ=qux"}) {
+		t.Errorf("Unexpected env %v", c.Env)
+	}
+
+	_, err = parseConfig("/etc/dockersh.yml", []byte("dockersh:\n  imagename: busybox\n  imagname: ubuntu\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "/etc/dockersh.yml:3: ") {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func Test_parseConfig_toml(t *testing.T) {
+	inicfg, err := parseConfig("/etc/dockersh.toml", []byte(`[dockersh]
+imagename = "busybox"
+capdrop = ["NET_RAW"]
+
+[group.ops]
+imagename = "ubuntu"
+
+[group.developers]
+imagename = "golang"
+
+[user.fred]
+shell = "/bin/zsh"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inicfg.groupOrder, []string{"ops", "developers"}) {
+		t.Errorf("Unexpected group order %v", inicfg.groupOrder)
+	}
+	c := composeConfigs([]iniConfig{inicfg}, "fred", []string{"developers", "ops"})
+	if c.ImageName != "golang" || c.Shell != "/bin/zsh" || !reflect.DeepEqual(c.CapDrop, []string{"NET_RAW"}) {
+		t.Errorf("Unexpected config %+v", c)
+	}
+
+	_, err = parseConfig("/etc/dockersh.toml", []byte("[dockersh]\nimagname = \"ubuntu\"\n"))
+	if err == nil || !strings.Contains(err.Error(), "unknown setting dockersh.imagname") {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func Test_parseConfig_contents(t *testing.T) {
+	shadow := []byte("root:$6$abcdefgh$SECRETHASH:19000:0:99999:7:::\n")
+	for _, fn := range []string{"/tmp/x.yaml", "/tmp/x.toml"} {
+		_, err := parseConfig(fn, shadow)
+		if err == nil || strings.Contains(err.Error(), "SECRETHASH") {
+			t.Errorf("Error for %s shows the contents: %v", fn, err)
+		}
+	}
+	_, err := parseConfig("/tmp/x.yaml", []byte("dockersh:\n  mounthome: hunter2\n"))
+	if err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Error shows the value: %v", err)
+	}
+}
+
+func Test_parseConfig_derived(t *testing.T) {
+	files := map[string]string{
+		"/etc/dockersh":      "[dockersh]\nuserid = 0\n",
+		"/etc/dockersh.yaml": "dockersh:\n  userid: 0\n",
+		"/etc/dockersh.toml": "[dockersh]\nuserid = 0\n",
+	}
+	for fn, contents := range files {
+		_, err := parseConfig(fn, []byte(contents))
+		if err == nil || !strings.HasPrefix(err.Error(), fn+":") || !strings.Contains(err.Error(), "unknown setting") {
+			t.Errorf("Unexpected error for %s: %v", fn, err)
+		}
+	}
+}
@@ -1,29 +1,58 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
+	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh/terminal"
 	"golang.org/x/net/context"
 )
 
-func isContainerRunning(name string) (string, error) {
+// Labels identifying the containers managed by dockersh. Containers are looked
+// up by exact label match rather than by name, as the docker name filter
+// matches substrings.
+const (
+	userLabel        = "dockersh.user"
+	profileLabel     = "dockersh.profile"
+	idleTimeoutLabel = "dockersh.idletimeout"
+)
+
+func containerFilter(config Configuration) filters.Args {
+	filter := filters.NewArgs()
+	filter.Add("label", fmt.Sprintf("%s=%d", userLabel, config.UserId))
+	filter.Add("label", fmt.Sprintf("%s=%s", profileLabel, config.Profile))
+	return filter
+}
+
+func isContainerRunning(config Configuration) (string, error) {
+	return findContainer(config, false)
+}
+
+func containerID(config Configuration) (string, error) {
+	return findContainer(config, true)
+}
+
+func findContainer(config Configuration, all bool) (string, error) {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return "", err
 	}
 
-	filter := filters.NewArgs()
-	filter.Add("name", name)
-	containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{Filters: filter})
+	containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{All: all, Filters: containerFilter(config)})
 	if err != nil {
 		return "", err
 	}
@@ -35,34 +64,148 @@ func isContainerRunning(name string) (string, error) {
 	return "", nil
 }
 
-func containerID(name string) (string, error) {
+// listContainers returns all the containers managed by dockersh.
+func listContainers(all bool) ([]types.Container, error) {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	filter := filters.NewArgs()
-	filter.Add("name", name)
-	containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{All: true, Filters: filter})
+	filter.Add("label", userLabel)
+	return cli.ContainerList(context.Background(), types.ContainerListOptions{All: all, Filters: filter})
+}
+
+// userContainers returns the containers of a user, of one profile or all of
+// them if profile is "".
+func userContainers(uid int, profile string) ([]types.Container, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if len(containers) >= 1 {
-		return containers[0].ID, nil
+	filter := filters.NewArgs()
+	filter.Add("label", fmt.Sprintf("%s=%d", userLabel, uid))
+	if profile != "" {
+		filter.Add("label", fmt.Sprintf("%s=%s", profileLabel, profile))
 	}
+	return cli.ContainerList(context.Background(), types.ContainerListOptions{All: true, Filters: filter})
+}
 
-	return "", nil
+func killContainer(id string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+
+	return cli.ContainerKill(context.Background(), id, "KILL")
+}
+
+func removeVolume(name string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+
+	return cli.VolumeRemove(context.Background(), name, true)
+}
+
+func containerLogs(id string, stdout io.Writer, stderr io.Writer) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+
+	r, err := cli.ContainerLogs(context.Background(), id, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = stdcopy.StdCopy(stdout, stderr, r)
+	return err
+}
+
+func containerStats(id string) (types.StatsJSON, error) {
+	var stats types.StatsJSON
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return stats, err
+	}
+
+	resp, err := cli.ContainerStats(context.Background(), id, false)
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	return stats, err
+}
+
+func stopContainer(id string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+
+	return cli.ContainerStop(context.Background(), id, nil)
 }
 
+// verifyContainerOwner checks that the container belongs to, and runs as, the
+// calling user.
+func verifyContainerOwner(id string, config Configuration) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+
+	c, err := cli.ContainerInspect(context.Background(), id)
+	if err != nil {
+		return err
+	}
+
+	if c.Config.Labels[userLabel] != strconv.Itoa(config.UserId) {
+		return fmt.Errorf("container %s is labelled for uid %q, not %d", id, c.Config.Labels[userLabel], config.UserId)
+	}
+	if c.Config.User != fmt.Sprintf("%d:%d", config.UserId, config.GroupId) {
+		return fmt.Errorf("container %s runs as %q, not %d:%d", id, c.Config.User, config.UserId, config.GroupId)
+	}
+
+	return nil
+}
+
+// isLegacyContainer reports whether c is the user's container created by a
+// version of dockersh which didn't label containers with the uid and profile,
+// and only identified them by name and the user label.
+func isLegacyContainer(c types.ContainerJSON, config Configuration) bool {
+	if c.ContainerJSONBase == nil || c.Config == nil {
+		return false
+	}
+	if _, ok := c.Config.Labels[userLabel]; ok {
+		return false
+	}
+	return c.Name == "/"+config.ContainerName &&
+		c.Config.Labels["user"] == config.ContainerUsername &&
+		c.Config.User == fmt.Sprintf("%d:%d", config.UserId, config.GroupId)
+}
+
+// configHashLabel is the container label holding the hash of the
+// configuration the container was created with.
+const configHashLabel = "dockersh.confighash"
+
 func startContainer(config Configuration) (string, error) {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return "", err
 	}
 
-	id, err := containerID(config.ContainerName)
-	logrus.Debugf("Checking if container with name %v already exists: %v", config.ContainerName, id != "")
+	id, err := containerID(config)
+	if err != nil {
+		return "", err
+	}
+	logrus.Debugf("Checking if container for profile %v already exists: %v", config.Profile, id != "")
 
 	if id != "" {
 		logrus.Debugf("Removing container, name: %v id: %v", config.ContainerName, id)
@@ -73,6 +216,61 @@ func startContainer(config Configuration) (string, error) {
 		}
 	}
 
+	ctx := context.Background()
+
+	// A container which is not labelled for this user may still hold the name
+	c, err := cli.ContainerInspect(ctx, config.ContainerName)
+	if err == nil && c.Name == "/"+config.ContainerName {
+		if !isLegacyContainer(c, config) {
+			return "", fmt.Errorf("container name %s is already in use by container %s", config.ContainerName, c.ID)
+		}
+		logrus.Infof("Removing container %v of uid %v created without dockersh labels", c.ID, config.UserId)
+		if err := removeContainer(c.ID); err != nil {
+			return "", err
+		}
+	}
+
+	if err := checkUserns(ctx, cli, config); err != nil {
+		return "", err
+	}
+
+	if config.ForwardAgent {
+		// Create it now, or the daemon creates it owned by root
+		hostUid, hostGid, err := hostIDs(config)
+		if err != nil {
+			return "", err
+		}
+		if _, err := ensureAgentDir(config.UserId, hostUid, hostGid); err != nil {
+			return "", err
+		}
+	}
+
+	containerConfig, hostConfig, err := containerSpec(config)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := configHash(ctx, cli, containerConfig, hostConfig)
+	if err != nil {
+		return "", err
+	}
+	containerConfig.Labels[configHashLabel] = hash
+
+	resp, err := cli.ContainerCreate(ctx, containerConfig, hostConfig, nil, config.ContainerName)
+	if err != nil {
+		return "", err
+	}
+
+	if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return "", err
+	}
+
+	return resp.ID, nil
+}
+
+// containerSpec builds the docker container and host configuration for the
+// user's container from the dockersh configuration.
+func containerSpec(config Configuration) (*container.Config, *container.HostConfig, error) {
 	binds := []string{"/etc/passwd:/etc/passwd:ro", "/etc/group:/etc/group:ro"}
 
 	var init []string
@@ -92,6 +290,11 @@ func startContainer(config Configuration) (string, error) {
 		logrus.Debugf("Bind mounting /tmp")
 		binds = append(binds, "/tmp:/tmp:rw")
 	}
+	if config.ForwardAgent {
+		a := fmt.Sprintf("%s:%s:rw", agentDir(config.UserId), agentContainerDir)
+		logrus.Debugf("Bind mounting agent directory: %v", a)
+		binds = append(binds, a)
+	}
 	if config.MountHome {
 		h := fmt.Sprintf("%s:%s:rw", config.MountHomeFrom, config.MountHomeTo)
 		logrus.Debugf("Bind mounting home: %v", h)
@@ -102,87 +305,326 @@ func startContainer(config Configuration) (string, error) {
 		binds = append(binds, config.DockerSocket+":/var/run/docker.sock")
 	}
 
-	hostname, _ := os.Hostname()
+	res, err := resources(config)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	ctx := context.Background()
+	securityOpt, err := securityOpts(config)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	resp, err := cli.ContainerCreate(ctx,
-		&container.Config{
-			Hostname:        hostname,
-			User:            fmt.Sprintf("%d:%d", config.UserId, config.GroupId),
-			AttachStdin:     false,
-			AttachStdout:    false,
-			AttachStderr:    false,
-			Tty:             false,
-			OpenStdin:       false,
-			StdinOnce:       false,
-			Env:             env,
-			Healthcheck:     nil,
-			Image:           config.ImageName,
-			Volumes:         nil,
-			WorkingDir:      config.UserCwd,
-			Entrypoint:      init,
-			NetworkDisabled: false,
-			Labels:          map[string]string{"user": config.ContainerUsername},
-			StopSignal:      "",
-			StopTimeout:     nil,
-			Shell:           []string{"/bin/bash"},
-		},
-		&container.HostConfig{
-			Binds:      binds,
-			AutoRemove: true,
-			// Applicable to UNIX platforms
-			CapAdd:          nil,
-			CapDrop:         []string{"SETUID", "SETGID", "NET_RAW", "MKNOD"},
-			Capabilities:    nil,
-			Privileged:      false,
-			PublishAllPorts: false,
-			ReadonlyRootfs:  true,
-			SecurityOpt:     nil, // TODO: Enable selinux etc
-			//UsernsMode:      UsernsMode, // TODO: Enable the user namespace to use for the container
+	capAdd, err := normalizeCaps(config.CapAdd)
+	if err != nil {
+		return nil, nil, err
+	}
+	capDrop, err := normalizeCaps(config.CapDrop)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exposedPorts, portBindings, err := reverseForwards(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostname, _ := os.Hostname()
+
+	containerConfig := &container.Config{
+		Hostname:        hostname,
+		User:            fmt.Sprintf("%d:%d", config.UserId, config.GroupId),
+		AttachStdin:     false,
+		AttachStdout:    false,
+		AttachStderr:    false,
+		Tty:             false,
+		OpenStdin:       false,
+		StdinOnce:       false,
+		Env:             env,
+		ExposedPorts:    exposedPorts,
+		Healthcheck:     nil,
+		Image:           config.ImageName,
+		Volumes:         nil,
+		WorkingDir:      config.UserCwd,
+		Entrypoint:      init,
+		NetworkDisabled: false,
+		Labels: map[string]string{
+			"user":       config.ContainerUsername,
+			userLabel:    strconv.Itoa(config.UserId),
+			profileLabel: config.Profile,
 		},
-		nil, config.ContainerName)
+		StopSignal:  "",
+		StopTimeout: nil,
+		Shell:       []string{"/bin/bash"},
+	}
+
+	if config.IdleTimeout != "" {
+		containerConfig.Labels[idleTimeoutLabel] = config.IdleTimeout
+	}
+
+	hostConfig := &container.HostConfig{
+		Binds:        binds,
+		AutoRemove:   true,
+		Resources:    res,
+		PortBindings: portBindings,
+		// Applicable to UNIX platforms
+		CapAdd:          capAdd,
+		CapDrop:         capDrop,
+		Capabilities:    nil,
+		Privileged:      false,
+		PublishAllPorts: false,
+		ReadonlyRootfs:  true,
+		SecurityOpt:     securityOpt,
+	}
+
+	// "private" relies on the daemon's userns-remap, which is what the
+	// daemon default gives, so only "host" needs to be asked for.
+	if config.UsernsMode == "host" {
+		hostConfig.UsernsMode = "host"
+	}
+
+	return containerConfig, hostConfig, nil
+}
+
+// reverseForwards publishes the reverse forwarded container ports on the
+// host's loopback interface only, so that they are reachable from the host
+// but not from the network.
+func reverseForwards(config Configuration) (nat.PortSet, nat.PortMap, error) {
+	if len(config.ReverseForward) == 0 {
+		return nil, nil, nil
+	}
+
+	exposedPorts := nat.PortSet{}
+	portBindings := nat.PortMap{}
+	for _, f := range config.ReverseForward {
+		hostPort, containerPort, err := parsePortforwardString(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		port := nat.Port(fmt.Sprintf("%d/tcp", containerPort))
+		logrus.Debugf("Forwarding 127.0.0.1:%v to container port %v", hostPort, port)
+		exposedPorts[port] = struct{}{}
+		portBindings[port] = append(portBindings[port], nat.PortBinding{HostIP: "127.0.0.1", HostPort: strconv.Itoa(hostPort)})
+	}
+
+	return exposedPorts, portBindings, nil
+}
+
+// remapUser is the user whose subordinate uid range the daemon uses when it
+// is started with --userns-remap=default.
+const remapUser = "dockremap"
+
+func daemonUsernsRemap(ctx context.Context, cli *client.Client) (bool, error) {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	opts, err := types.DecodeSecurityOptions(info.SecurityOptions)
+	if err != nil {
+		return false, err
+	}
+	for _, o := range opts {
+		if o.Name == "userns" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// checkUserns verifies that the daemon can provide the requested user
+// namespace mode. When the container will run in a remapped user namespace,
+// the user's uid maps to a subordinate uid on the host, so a bind mounted home
+// directory needs to be owned by that uid to be writable. The /etc/passwd and
+// /etc/group binds stay readable, they just show up as owned by nobody.
+func checkUserns(ctx context.Context, cli *client.Client, config Configuration) error {
+	if config.UsernsMode == "host" {
+		return nil
+	}
+
+	remapped, err := daemonUsernsRemap(ctx, cli)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Daemon has userns-remap enabled? %v", remapped)
+
+	if !remapped {
+		if config.UsernsMode == "private" {
+			return fmt.Errorf("usernsmode = private requires the docker daemon to run with userns-remap enabled")
+		}
+		return nil
+	}
+
+	if !config.MountHome {
+		return nil
+	}
+
+	start, err := subordinateID("/etc/subuid", remapUser)
+	if err != nil {
+		logrus.Debugf("Could not look up the remapped uid range: %v", err)
+		return nil
+	}
+	hostUid := start + config.UserId
+
+	fi, err := os.Stat(config.MountHomeFrom)
+	if err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != hostUid {
+		logrus.Warnf("%s is owned by uid %d, but uid %d in the container maps to uid %d on the host, so it won't be writable",
+			config.MountHomeFrom, st.Uid, config.UserId, hostUid)
+	}
+
+	return nil
+}
+
+// hostIDs returns the uid and gid on the host which the user's uid and gid in
+// the container map to. They're the same unless the container runs in a user
+// namespace remapped to the subordinate ids of remapUser.
+func hostIDs(config Configuration) (int, int, error) {
+	if config.UsernsMode == "host" {
+		return config.UserId, config.GroupId, nil
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return 0, 0, err
+	}
+	remapped, err := daemonUsernsRemap(context.Background(), cli)
+	if err != nil || !remapped {
+		return config.UserId, config.GroupId, err
+	}
+
+	uidStart, err := subordinateID("/etc/subuid", remapUser)
+	if err != nil {
+		return 0, 0, err
+	}
+	gidStart, err := subordinateID("/etc/subgid", remapUser)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uidStart + config.UserId, gidStart + config.GroupId, nil
+}
+
+// configHash returns the hash the user's container is expected to carry in
+// its configHashLabel, covering the container spec and the image it runs.
+func configHash(ctx context.Context, cli *client.Client, containerConfig *container.Config, hostConfig *container.HostConfig) (string, error) {
+	image, _, err := cli.ImageInspectWithRaw(ctx, containerConfig.Image)
 	if err != nil {
 		return "", err
 	}
 
-	if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+	return specHash(containerConfig, hostConfig, image.ID)
+}
+
+func specHash(containerConfig *container.Config, hostConfig *container.HostConfig, imageID string) (string, error) {
+	b, err := json.Marshal(struct {
+		Config     *container.Config
+		HostConfig *container.HostConfig
+		ImageID    string
+	}{containerConfig, hostConfig, imageID})
+	if err != nil {
 		return "", err
 	}
 
-	return resp.ID, nil
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
 }
 
-func execContainer(id string, config Configuration) error {
-	// TODO: Move to proper docker client API
+// isContainerStale reports whether the running container was created from a
+// different configuration (or image) than the one currently in effect.
+func isContainerStale(id string, config Configuration) (bool, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return false, err
+	}
+
+	ctx := context.Background()
 
-	dockerBinary, err := exec.LookPath("docker")
+	c, err := cli.ContainerInspect(ctx, id)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	containerConfig, hostConfig, err := containerSpec(config)
+	if err != nil {
+		return false, err
+	}
+	hash, err := configHash(ctx, cli, containerConfig, hostConfig)
+	if err != nil {
+		return false, err
 	}
 
-	args := []string{dockerBinary}
-	args = append(args, "exec")
-	args = append(args, "--user")
-	args = append(args, fmt.Sprintf("%d:%d", config.UserId, config.GroupId))
-	args = append(args, "--workdir")
-	args = append(args, config.UserCwd)
+	return c.Config.Labels[configHashLabel] != hash, nil
+}
 
-	for _, e := range config.Env {
-		args = append(args, "-e")
-		args = append(args, e)
+// activeExecs returns the number of exec sessions still running inside the
+// container.
+func activeExecs(id string) (int, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+
+	c, err := cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, execID := range c.ExecIDs {
+		e, err := cli.ContainerExecInspect(ctx, execID)
+		if err != nil {
+			if client.IsErrNotFound(err) {
+				continue
+			}
+			return 0, err
+		}
+		if e.Running {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func removeContainer(id string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
 	}
 
-	if terminal.IsTerminal(int(os.Stdout.Fd())) {
-		args = append(args, "--tty")
+	err = cli.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{Force: true})
+	if err != nil && !client.IsErrNotFound(err) {
+		return err
 	}
 
-	args = append(args, "--interactive")
+	return nil
+}
+
+// execContainer runs the shell (or cmd) in the container, attached to this
+// session, and returns the id of the exec. The process is killed when one of
+// the hangupSignals arrives on hangup.
+func execContainer(id string, config Configuration, hangup <-chan os.Signal) (string, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", err
+	}
 
-	args = append(args, id)
+	tty := terminal.IsTerminal(int(os.Stdout.Fd()))
 
-	args = append(args, config.Shell)
-	if cmd != "" {
+	args := []string{config.Shell}
+	if isFileTransfer(cmd) {
+		tty = false
+		if isSftp(cmd) {
+			args = sftpCommand(config, cmd)
+		} else {
+			args = append(args, "-c")
+			args = append(args, cmd)
+		}
+	} else if cmd != "" {
 		args = append(args, "-c")
 		args = append(args, cmd)
 	} else {
@@ -192,9 +634,210 @@ func execContainer(id string, config Configuration) error {
 		}
 	}
 
-	if err := syscall.Exec(args[0], args, os.Environ()); err != nil {
-		return err
+	ctx := context.Background()
+
+	exec, err := cli.ContainerExecCreate(ctx, id, types.ExecConfig{
+		User:         fmt.Sprintf("%d:%d", config.UserId, config.GroupId),
+		Tty:          tty,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Env:          config.Env,
+		WorkingDir:   config.UserCwd,
+		Cmd:          args,
+	})
+	if err != nil {
+		return "", err
 	}
+	logrus.Debugf("Created exec: id=%v cmd=%v tty=%v", exec.ID, args, tty)
 
-	return nil
+	resp, err := cli.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{Tty: tty})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Close()
+
+	stdinFd := int(os.Stdin.Fd())
+	if tty && terminal.IsTerminal(stdinFd) {
+		oldState, err := terminal.MakeRaw(stdinFd)
+		if err != nil {
+			return "", err
+		}
+		defer terminal.Restore(stdinFd, oldState)
+	}
+
+	if tty {
+		stop := monitorTtySize(ctx, cli, exec.ID)
+		defer stop()
+	}
+
+	output := make(chan error, 1)
+	go func() {
+		output <- pumpStreams(resp, tty)
+	}()
+
+	select {
+	case err := <-output:
+		return exec.ID, err
+	case sig := <-hangup:
+		// Don't leave the process running in the container without its
+		// session (the terminal is restored by the deferred calls)
+		logrus.Debugf("Got %v, killing exec %v", sig, exec.ID)
+		if err := killExec(ctx, cli, exec.ID); err != nil {
+			logrus.Warnf("Could not kill exec %v: %v", exec.ID, err)
+		}
+		return exec.ID, fmt.Errorf("session ended by %v", sig)
+	}
+}
+
+// hangupSignals end the session: sshd sends SIGHUP or SIGTERM when the
+// connection goes away, and writing to it afterwards raises SIGPIPE.
+var hangupSignals = []os.Signal{syscall.SIGHUP, syscall.SIGTERM, syscall.SIGPIPE}
+
+const killExecTimeout = 5 * time.Second
+
+// killExec hangs up the process of an exec, like a terminal hangup does (so
+// that shells pass it on to their jobs), and kills it if it is still running
+// after killExecTimeout. The daemon reports the host pid of the process,
+// which dockersh can signal as it runs as root.
+func killExec(ctx context.Context, cli *client.Client, execID string) error {
+	for _, sig := range []syscall.Signal{syscall.SIGHUP, syscall.SIGKILL} {
+		inspect, err := cli.ContainerExecInspect(ctx, execID)
+		if err != nil || !inspect.Running || inspect.Pid == 0 {
+			return err
+		}
+		if err := syscall.Kill(inspect.Pid, sig); err != nil && err != syscall.ESRCH {
+			return err
+		}
+
+		deadline := time.Now().Add(killExecTimeout)
+		for time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+			inspect, err = cli.ContainerExecInspect(ctx, execID)
+			if err != nil || !inspect.Running {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("exec %s is still running", execID)
+}
+
+// resolveShell returns the first of the candidate shells which exists in the
+// container.
+func resolveShell(id string, candidates []string) (string, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+
+	for _, shell := range candidates {
+		stat, err := cli.ContainerStatPath(ctx, id, shell)
+		if err == nil && stat.Mode&os.ModeSymlink != 0 {
+			stat, err = cli.ContainerStatPath(ctx, id, stat.LinkTarget)
+		}
+		if err != nil {
+			logrus.Debugf("Shell %v not usable: %v", shell, err)
+			continue
+		}
+		if stat.Mode.IsRegular() && stat.Mode&0111 != 0 {
+			return shell, nil
+		}
+		logrus.Debugf("Shell %v is not an executable file", shell)
+	}
+
+	return "", fmt.Errorf("none of the shells %v exist in the container", candidates)
+}
+
+// monitorTtySize resizes the exec tty to the size of the local terminal, and
+// keeps doing so every time the terminal is resized (SIGWINCH). The returned
+// function stops the monitoring.
+func monitorTtySize(ctx context.Context, cli *client.Client, execID string) func() {
+	resizeTty(ctx, cli, execID)
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigchan:
+				resizeTty(ctx, cli, execID)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigchan)
+		close(done)
+	}
+}
+
+func resizeTty(ctx context.Context, cli *client.Client, execID string) {
+	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		logrus.Debugf("Could not get terminal size: %v", err)
+		return
+	}
+	if width == 0 || height == 0 {
+		return
+	}
+
+	logrus.Debugf("Resizing exec %v tty to %vx%v", execID, width, height)
+	err = cli.ContainerExecResize(ctx, execID, types.ResizeOptions{Height: uint(height), Width: uint(width)})
+	if err != nil {
+		logrus.Debugf("Could not resize exec tty: %v", err)
+	}
+}
+
+// pumpStreams copies the local stdin into the hijacked exec connection and
+// the exec output back to the local stdout/stderr. It returns once the
+// output stream has been closed by the daemon. Without a tty the daemon
+// multiplexes stdout and stderr on one stream, so it has to be demuxed.
+func pumpStreams(resp types.HijackedResponse, tty bool) error {
+	outputDone := make(chan error, 1)
+	go func() {
+		var err error
+		if tty {
+			_, err = io.Copy(os.Stdout, resp.Reader)
+		} else {
+			_, err = stdcopy.StdCopy(os.Stdout, os.Stderr, resp.Reader)
+		}
+		outputDone <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(resp.Conn, os.Stdin)
+		if err != nil {
+			logrus.Debugf("Error copying stdin: %v", err)
+		}
+		if err := resp.CloseWrite(); err != nil {
+			logrus.Debugf("Error closing exec stdin: %v", err)
+		}
+	}()
+
+	return <-outputDone
+}
+
+// execExitCode returns the exit code of a finished exec. The daemon already
+// reports 128+signal for processes which were killed by a signal.
+func execExitCode(execID string) (int, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return 0, err
+	}
+
+	inspect, err := cli.ContainerExecInspect(context.Background(), execID)
+	if err != nil {
+		return 0, err
+	}
+
+	if inspect.Running {
+		return 0, fmt.Errorf("exec %s is still running", execID)
+	}
+
+	return inspect.ExitCode, nil
 }
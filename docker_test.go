@@ -2,38 +2,10 @@ package main
 
 import (
 	"testing"
-)
-
-func Test_dockerPid_1(t *testing.T) {
-	pid, err := dockerpid("testcontainer")
-	if err != nil {
-		t.Errorf("Error from dockerpid: %v", err)
-	}
-	if pid != 666 {
-		t.Errorf("PID was %v expected 666", pid)
-	}
-}
-
-func Test_dockerSha_1(t *testing.T) {
-	sha, err := dockersha("testcontainer")
-	if err != nil {
-		t.Errorf("Error from dockersha: %v", err)
-	}
-	if sha != "666" {
-		t.Errorf("SHA was %v expected 666", sha)
-	}
-}
 
-func Test_dockerStart(t *testing.T) {
-	c := Configuration{ContainerName: "somecontainer", ImageName: "busybox", MountHome: true, MountHomeFrom: "/home/fred", MountHomeTo: "/home/fred", Entrypoint: "internal", DockerSocket: "dockersock", Cmd: []string{"foo"}, DockerOpt: []string{"bar"}}
-	pid, err := dockerstart(c)
-	if err != nil {
-		t.Errorf("Error from dockerstart: %v", err)
-	}
-	if pid != 666 {
-		t.Errorf("PID was %v expected 666", pid)
-	}
-}
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
 
 func Test_validatePortforwardString_1(t *testing.T) {
 	err := validatePortforwardString("1:2")
@@ -69,3 +41,76 @@ func Test_validatePortforwardString_5(t *testing.T) {
 		t.Errorf("No error on foo:2")
 	}
 }
+
+func Test_specHash_1(t *testing.T) {
+	c := Configuration{ImageName: "busybox", Entrypoint: "internal", Env: []string{"FOO=bar"}}
+	cfg, hostCfg, _ := containerSpec(c)
+	h1, err := specHash(cfg, hostCfg, "sha256:1")
+	if err != nil {
+		t.Errorf("Error from specHash: %v", err)
+	}
+	h2, _ := specHash(cfg, hostCfg, "sha256:1")
+	if h1 != h2 {
+		t.Errorf("Hash not stable: %v != %v", h1, h2)
+	}
+	h3, _ := specHash(cfg, hostCfg, "sha256:2")
+	if h1 == h3 {
+		t.Errorf("Hash did not change with the image")
+	}
+	c.Env = []string{"FOO=baz"}
+	cfg, hostCfg, _ = containerSpec(c)
+	h4, _ := specHash(cfg, hostCfg, "sha256:1")
+	if h1 == h4 {
+		t.Errorf("Hash did not change with the env")
+	}
+}
+
+func Test_containerFilter_1(t *testing.T) {
+	c := Configuration{UserId: 1000, Profile: "busybox"}
+	f := containerFilter(c)
+	if !f.ExactMatch("label", "dockersh.user=1000") {
+		t.Errorf("Missing user label filter: %v", f.Get("label"))
+	}
+	if !f.ExactMatch("label", "dockersh.profile=busybox") {
+		t.Errorf("Missing profile label filter: %v", f.Get("label"))
+	}
+	if f.Contains("name") {
+		t.Error("Unexpected name filter")
+	}
+}
+
+func Test_reverseForwards_1(t *testing.T) {
+	c := Configuration{ReverseForward: []string{"8080:80", "8443:443"}}
+	exposed, bindings, err := reverseForwards(c)
+	if err != nil {
+		t.Errorf("Error from reverseForwards: %v", err)
+	}
+	if _, ok := exposed["80/tcp"]; !ok {
+		t.Errorf("Port 80 not exposed: %v", exposed)
+	}
+	b := bindings["443/tcp"]
+	if len(b) != 1 || b[0].HostIP != "127.0.0.1" || b[0].HostPort != "8443" {
+		t.Errorf("Unexpected binding for port 443: %v", b)
+	}
+}
+
+func Test_isLegacyContainer_1(t *testing.T) {
+	config := Configuration{ContainerName: "fred_dockersh_busybox", ContainerUsername: "fred", UserId: 1000, GroupId: 1000}
+	c := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{Name: "/fred_dockersh_busybox"},
+		Config:            &container.Config{User: "1000:1000", Labels: map[string]string{"user": "fred"}},
+	}
+	if !isLegacyContainer(c, config) {
+		t.Error("Expected a legacy container")
+	}
+
+	c.Config.User = "1001:1001"
+	if isLegacyContainer(c, config) {
+		t.Error("Legacy container of another uid")
+	}
+	c.Config.User = "1000:1000"
+	c.Config.Labels[userLabel] = "1001"
+	if isLegacyContainer(c, config) {
+		t.Error("Labelled container taken for a legacy one")
+	}
+}
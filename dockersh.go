@@ -4,18 +4,24 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 
 	"github.com/sirupsen/logrus"
 )
 
 var debug bool
 var cmd string
+var status, restart, logs bool
 
 func init() {
 	flag.BoolVar(&debug, "debug", false, "Enable debug logging. Default : 'false'")
 	flag.StringVar(&cmd, "c", "", "Run command inside the container, using login shell")
-	flag.Parse()
+	flag.BoolVar(&status, "status", false, "Show the status of your container")
+	flag.BoolVar(&restart, "restart", false, "Restart your container, ending all your sessions in it")
+	flag.BoolVar(&logs, "logs", false, "Show the output of your container's entrypoint")
+}
 
+func setupLogging() {
 	lvl, ok := os.LookupEnv("LOG_LEVEL")
 	if ok {
 		ll, err := logrus.ParseLevel(lvl)
@@ -32,40 +38,247 @@ func init() {
 }
 
 func main() {
+	flag.Parse()
+	setupLogging()
+
+	if flag.NArg() > 0 {
+		os.Exit(runSubcommand(flag.Arg(0), flag.Args()[1:]))
+	}
+
 	logrus.Debug("Starting dockersh")
 
 	logrus.Debug("Loading all config files")
 	config, err := loadAllConfig()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not load config: %v\n", err)
-		return
+		os.Exit(1)
 	}
 	logrus.Debugf("Config dump: %+v", config)
 
-	logrus.Debugf("Checking for container: name=%v", config.ContainerName)
-	id, err := isContainerRunning(config.ContainerName)
+	// When used as a ForceCommand, sshd passes the command the client asked
+	// for in SSH_ORIGINAL_COMMAND
+	if cmd == "" {
+		cmd = os.Getenv("SSH_ORIGINAL_COMMAND")
+	}
+
+	// Self service commands, also available as e.g. ssh host dockersh-restart
+	switch {
+	case status || cmd == "dockersh-status":
+		os.Exit(statusCommand(config))
+	case restart || cmd == "dockersh-restart":
+		os.Exit(restartCommand(config))
+	case logs || cmd == "dockersh-logs":
+		os.Exit(logsCommand(config))
+	}
+
+	if cmd != "" {
+		logrus.Debugf("Command: %v", cmd)
+		if err := checkCommand(config, cmd); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// From here on the signals ending the session are handled, by killing
+	// the process in the container (see execContainer), so that the session
+	// is always ended
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, hangupSignals...)
+
+	id, err := ensureContainer(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	logrus.Debugf("Container ID: %v", id)
+
+	exitCode := runSession(id, config, hangup)
+
+	if config.Lifecycle == "session" {
+		if err := endSession(id, config); err != nil {
+			fmt.Fprintf(os.Stderr, "could not end session: %v\n", err)
+		}
+	}
+
+	os.Exit(exitCode)
+}
+
+// runSession runs the user's shell or command in the container, and returns
+// the exit code for dockersh.
+func runSession(id string, config Configuration, hangup <-chan os.Signal) int {
+	var err error
+	if config.Shell == "" {
+		config.Shell, err = resolveShell(id, config.ShellFallback)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not find a shell: %v\n", err)
+			return 1
+		}
+		logrus.Debugf("Using shell %v", config.Shell)
+	}
+
+	stopAgent := func() {}
+	if config.ForwardAgent {
+		sock, stop, err := forwardAgent(config)
+		if err != nil {
+			logrus.Warnf("%v", err)
+		} else if sock != "" {
+			stopAgent = stop
+			config.Env = append(config.Env, "SSH_AUTH_SOCK="+sock)
+		}
+	}
+
+	logrus.Debug("Exec into the container")
+
+	touchActivity(config)
+	execID, err := execContainer(id, config, hangup)
+	stopAgent()
+	touchActivity(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not exec into container: %v\n", err)
+		return 1
+	}
+
+	exitCode, err := execExitCode(execID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not get exit status: %v\n", err)
+		return 1
+	}
+	logrus.Debugf("Exec %v exited with %v", execID, exitCode)
+
+	return exitCode
+}
+
+func runSubcommand(name string, args []string) int {
+	switch name {
+	case "reap":
+		return reapCommand(args)
+	case "admin":
+		return adminCommand(args)
+	case "config":
+		return configCommand(args)
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\n", name)
+	return 2
+}
+
+// ensureContainer returns the id of the user's running container, starting
+// (or recycling) it if needed. Concurrent logins of the same user are
+// serialized so that they don't race to create the container.
+func ensureContainer(config Configuration) (string, error) {
+	logrus.Debug("Taking the per-user lock")
+	unlock, err := lockUser(config.UserId)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not check container status: %v\n", err)
-		return
+		return "", fmt.Errorf("Could not lock user: %v", err)
+	}
+	defer unlock()
+
+	logrus.Debugf("Checking for container: uid=%v profile=%v", config.UserId, config.Profile)
+	id, err := isContainerRunning(config)
+	if err != nil {
+		return "", fmt.Errorf("Could not check container status: %v", err)
 	}
 	logrus.Debugf("Container running? %v", id != "")
 
+	if id != "" {
+		id, err = recycleContainer(id, config)
+		if err != nil {
+			return "", fmt.Errorf("Could not recycle container: %v", err)
+		}
+	}
+
+	if id != "" && config.Lifecycle == "session" {
+		// Left over by a session which didn't get to stop it
+		n, err := liveSessions(config)
+		if err != nil {
+			return "", fmt.Errorf("Could not read sessions: %v", err)
+		}
+		if n == 0 {
+			logrus.Debugf("Removing container %v without sessions", id)
+			if err := removeContainer(id); err != nil {
+				return "", fmt.Errorf("Could not remove container: %v", err)
+			}
+			id = ""
+		}
+	}
+
 	if id == "" {
 		logrus.Debug("Container is not running, starting it")
 		id, err = startContainer(config)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "could not start container: %s\n", err)
-			return
+			return "", fmt.Errorf("could not start container: %s", err)
 		}
 	}
 
-	logrus.Debugf("Container ID: %v", id)
-	logrus.Debug("Exec into the container")
+	// Checked before the session is registered, so that ending it never
+	// stops a container which isn't the user's
+	if err := verifyContainerOwner(id, config); err != nil {
+		return "", fmt.Errorf("Refusing to exec into container: %v", err)
+	}
+
+	if config.Lifecycle == "session" {
+		if err := registerSession(config); err != nil {
+			return "", fmt.Errorf("Could not register session: %v", err)
+		}
+	}
 
-	err = execContainer(id, config)
+	return id, nil
+}
+
+// endSession stops the container once the last session in it has ended.
+func endSession(id string, config Configuration) error {
+	unlock, err := lockUser(config.UserId)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not exec into container: %v\n", err)
+		return err
+	}
+	defer unlock()
+
+	n, err := unregisterSession(config)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Sessions left: %v", n)
+	if n > 0 {
+		return nil
+	}
+
+	logrus.Debugf("Last session ended, stopping container %v", id)
+	return stopContainer(id)
+}
+
+// recycleContainer removes the running container if it was created with a
+// configuration different from the current one and the recycle policy allows
+// it. It returns the id of the container to use, or "" if it was removed.
+func recycleContainer(id string, config Configuration) (string, error) {
+	if config.Recycle == "never" {
+		return id, nil
+	}
+
+	stale, err := isContainerStale(id, config)
+	if err != nil {
+		return "", err
+	}
+	logrus.Debugf("Container configuration changed? %v", stale)
+	if !stale {
+		return id, nil
+	}
+
+	if config.Recycle == "idle" {
+		n, err := activeExecs(id)
+		if err != nil {
+			return "", err
+		}
+		if n > 0 {
+			logrus.Debugf("Container has %v active sessions, not recycling", n)
+			return id, nil
+		}
+	}
+
+	logrus.Debugf("Removing stale container %v", id)
+	if err := removeContainer(id); err != nil {
+		return "", err
 	}
 
-	return
+	return "", nil
 }
@@ -5,7 +5,7 @@ import (
 )
 
 func Test_templConfigVar_1(t *testing.T) {
-	i := configInterpolation{"foo", "bar"}
+	i := configInterpolation{"foo", "bar", "/bin/bash"}
 	out := tmplConfigVar("%s", &i)
 	if out == "/bin/bash" {
 		t.Log("OK")
@@ -15,7 +15,7 @@ func Test_templConfigVar_1(t *testing.T) {
 }
 
 func Test_getInterpolatedConfig_1(t *testing.T) {
-	i := configInterpolation{"foo", "bar"}
+	i := configInterpolation{"foo", "bar", "/bin/bash"}
 	c := defaultConfig
 	e := getInterpolatedConfig(&c, i)
 	if e != nil {
@@ -25,11 +25,3 @@ func Test_getInterpolatedConfig_1(t *testing.T) {
 		t.Errorf("MountHomeFrom is %s not foo", c.MountHomeFrom)
 	}
 }
-
-func Test_gatewayIP_1(t *testing.T) {
-	ip, err := gatewayIP()
-	if err != nil {
-		t.Error("Error")
-	}
-	t.Log(ip)
-}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// lockDir holds the per-user lock files. It and the files in it are owned by
+// root and only writable by root, so that users can't create or tamper with
+// each other's lock files; dockersh runs as root (suid) to write them.
+const lockDir = "/var/run/dockersh"
+
+const lockTimeout = 30 * time.Second
+
+// lockUser takes the per-user lock which serializes concurrent logins of the
+// same user. The returned function releases it.
+func lockUser(uid int) (func(), error) {
+	if err := checkLockDir(lockDir); err != nil {
+		return nil, err
+	}
+
+	f, err := acquireLock(filepath.Join(lockDir, fmt.Sprintf("%d.lock", uid)), lockTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func checkLockDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("could not create lock directory %s: %v", dir, err)
+		}
+		fi, err = os.Stat(dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("lock directory %s is not a directory", dir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || st.Uid != 0 {
+		return fmt.Errorf("lock directory %s is not owned by root", dir)
+	}
+	if fi.Mode()&0022 != 0 {
+		return fmt.Errorf("lock directory %s is writable by other users", dir)
+	}
+
+	return nil
+}
+
+// acquireLock opens (creating if needed) the lock file and takes an exclusive
+// flock on it, giving up after timeout.
+func acquireLock(path string, timeout time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file %s: %v", path, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, fmt.Errorf("could not lock %s: %v", path, err)
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("timed out after %v waiting for another login of this user to finish starting the container (lock %s)", timeout, path)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_acquireLock_1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockersh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.lock")
+	f, err := acquireLock(path, time.Second)
+	if err != nil {
+		t.Fatalf("Error from acquireLock: %v", err)
+	}
+	defer f.Close()
+
+	_, err = acquireLock(path, 200*time.Millisecond)
+	if err == nil {
+		t.Error("No error taking a held lock")
+	}
+}
+
+func Test_checkLockDir_1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockersh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Chmod(dir, 0777|os.ModeSticky)
+	if err := checkLockDir(dir); err == nil {
+		t.Error("No error for a world writable lock directory")
+	}
+}
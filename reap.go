@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/sirupsen/logrus"
+)
+
+// activityFile is touched when a session of the user's container starts and
+// ends, so that the reaper knows how long the container has been idle for.
+func activityFile(uid int, profile string) string {
+	return filepath.Join(lockDir, fmt.Sprintf("%d.%s.activity", uid, strings.Replace(profile, "/", "_", -1)))
+}
+
+func touchActivity(config Configuration) {
+	fn := activityFile(config.UserId, config.Profile)
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		logrus.Debugf("Could not record session activity: %v", err)
+		return
+	}
+	f.Close()
+
+	now := time.Now()
+	if err := os.Chtimes(fn, now, now); err != nil {
+		logrus.Debugf("Could not record session activity: %v", err)
+	}
+}
+
+func reapCommand(args []string) int {
+	flags := flag.NewFlagSet("reap", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Only log the containers which would be stopped")
+	idleTimeout := flags.Duration("idletimeout", 0, "Idle timeout for containers started without an idletimeout setting. Default: never stop them")
+	flags.Parse(args)
+
+	if err := requireAdmin(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	if err := reap(*idleTimeout, *dryRun); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not reap containers: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// reap stops the dockersh containers which haven't had a session for longer
+// than their idle timeout.
+func reap(defaultTimeout time.Duration, dryRun bool) error {
+	containers, err := listContainers(false)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range containers {
+		reapContainer(c, defaultTimeout, dryRun)
+	}
+
+	return nil
+}
+
+// reapContainer stops the container if it has been idle for longer than its
+// idle timeout. It holds the user's lock, so that a login can't start a
+// session in the container while it is being stopped.
+func reapContainer(c types.Container, defaultTimeout time.Duration, dryRun bool) {
+	timeout := defaultTimeout
+	if t, ok := c.Labels[idleTimeoutLabel]; ok {
+		var err error
+		timeout, err = time.ParseDuration(t)
+		if err != nil {
+			logrus.Warnf("Container %v has an invalid idle timeout %q", c.ID, t)
+			return
+		}
+	}
+	if timeout <= 0 {
+		return
+	}
+
+	uid, err := strconv.Atoi(c.Labels[userLabel])
+	if err != nil {
+		logrus.Warnf("Container %v has an invalid uid label %q", c.ID, c.Labels[userLabel])
+		return
+	}
+	unlock, err := lockUser(uid)
+	if err != nil {
+		logrus.Warnf("Could not lock uid %v: %v", uid, err)
+		return
+	}
+	defer unlock()
+
+	n, err := activeExecs(c.ID)
+	if err != nil {
+		logrus.Warnf("Could not count the sessions of container %v: %v", c.ID, err)
+		return
+	}
+	if n > 0 {
+		logrus.Debugf("Container %v has %v active sessions", c.ID, n)
+		return
+	}
+
+	idle := time.Now().Sub(lastActivity(c))
+	if idle < timeout {
+		logrus.Debugf("Container %v idle for %v, timeout %v", c.ID, idle, timeout)
+		return
+	}
+
+	if dryRun {
+		logrus.Infof("Would stop container %v (%v) of uid %v, idle for %v", c.ID, c.Names, uid, idle.Round(time.Second))
+		return
+	}
+	logrus.Infof("Stopping container %v (%v) of uid %v, idle for %v", c.ID, c.Names, uid, idle.Round(time.Second))
+	if err := stopContainer(c.ID); err != nil {
+		logrus.Warnf("Could not stop container %v: %v", c.ID, err)
+	}
+}
+
+// lastActivity returns when the container was last used: the end of its last
+// session, or when it was created if there's no record of one.
+func lastActivity(c types.Container) time.Time {
+	last := time.Unix(c.Created, 0)
+
+	uid, err := strconv.Atoi(c.Labels[userLabel])
+	if err != nil {
+		return last
+	}
+	fi, err := os.Stat(activityFile(uid, c.Labels[profileLabel]))
+	if err == nil && fi.ModTime().After(last) {
+		last = fi.ModTime()
+	}
+
+	return last
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+func Test_activityFile_1(t *testing.T) {
+	fn := activityFile(1000, "fred/shell_latest")
+	if fn != "/var/run/dockersh/1000.fred_shell_latest.activity" {
+		t.Errorf("Unexpected activity file %s", fn)
+	}
+}
+
+func Test_lastActivity_1(t *testing.T) {
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	c := types.Container{Created: created.Unix(), Labels: map[string]string{userLabel: "notanumber"}}
+	if last := lastActivity(c); !last.Equal(created) {
+		t.Errorf("Expected %v got %v", created, last)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// The self service commands let users look after their own container. They
+// only ever act on the container of the calling uid and current profile.
+
+func statusCommand(config Configuration) int {
+	containers, err := userContainers(config.UserId, config.Profile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check container status: %v\n", err)
+		return 1
+	}
+	if len(containers) == 0 {
+		fmt.Printf("Your %s container is not running, it will be started when you log in\n", config.Profile)
+		return 0
+	}
+	id := containers[0].ID
+	if err := verifyContainerOwner(id, config); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	i := getContainerInfo(containers[0])
+
+	fmt.Printf("Container:  %s (%s)\n", i.Name, i.ID[:12])
+	fmt.Printf("Image:      %s\n", i.Image)
+	fmt.Printf("State:      %s, up %s\n", i.State, units.HumanDuration(time.Duration(i.Uptime)*time.Second))
+	fmt.Printf("Sessions:   %d\n", i.Sessions)
+	fmt.Printf("Memory:     %s\n", units.BytesSize(float64(i.MemoryBytes)))
+
+	if i.State == "running" {
+		stale, err := isContainerStale(id, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not check configuration: %v\n", err)
+			return 1
+		}
+		if stale {
+			fmt.Printf("Config:     changed since the container started, restart it to apply (recycle = %s)\n", config.Recycle)
+		} else {
+			fmt.Printf("Config:     up to date\n")
+		}
+	}
+
+	return 0
+}
+
+func restartCommand(config Configuration) int {
+	unlock, err := lockUser(config.UserId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not lock user: %v\n", err)
+		return 1
+	}
+	defer unlock()
+
+	id, err := containerID(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check container status: %v\n", err)
+		return 1
+	}
+	if id != "" {
+		if err := verifyContainerOwner(id, config); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		if err := removeContainer(id); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not remove container: %v\n", err)
+			return 1
+		}
+		os.Remove(sessionsFile(config.UserId, config.Profile))
+	}
+
+	if config.Lifecycle == "session" {
+		fmt.Printf("Your %s container was stopped, it will be started when you log in\n", config.Profile)
+		return 0
+	}
+
+	id, err = startContainer(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not start container: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Your %s container was restarted (%s)\n", config.Profile, id[:12])
+
+	return 0
+}
+
+func logsCommand(config Configuration) int {
+	id, err := containerID(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check container status: %v\n", err)
+		return 1
+	}
+	if id == "" {
+		fmt.Fprintf(os.Stderr, "Your %s container is not running\n", config.Profile)
+		return 1
+	}
+	if err := verifyContainerOwner(id, config); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	if err := containerLogs(id, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not get logs: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
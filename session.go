@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The session ledger lists the pids of the dockersh processes with a session
+// in the user's container. It is only read and written with the user's lock
+// held. Pids of processes which are gone (e.g. killed along with the ssh
+// connection) are dropped when it is read.
+
+func sessionsFile(uid int, profile string) string {
+	return filepath.Join(lockDir, fmt.Sprintf("%d.%s.sessions", uid, strings.Replace(profile, "/", "_", -1)))
+}
+
+func readSessions(fn string) ([]int, error) {
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, l := range strings.Fields(string(b)) {
+		pid, err := strconv.Atoi(l)
+		if err != nil || !processAlive(pid) {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+func writeSessions(fn string, pids []int) error {
+	var b strings.Builder
+	for _, pid := range pids {
+		fmt.Fprintf(&b, "%d\n", pid)
+	}
+
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(b.String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// liveSessions returns the number of sessions in the user's container.
+func liveSessions(config Configuration) (int, error) {
+	pids, err := readSessions(sessionsFile(config.UserId, config.Profile))
+	return len(pids), err
+}
+
+// registerSession adds this process to the user's session ledger.
+func registerSession(config Configuration) error {
+	fn := sessionsFile(config.UserId, config.Profile)
+	pids, err := readSessions(fn)
+	if err != nil {
+		return err
+	}
+	return writeSessions(fn, append(pids, os.Getpid()))
+}
+
+// unregisterSession removes this process from the user's session ledger, and
+// returns the number of sessions left.
+func unregisterSession(config Configuration) (int, error) {
+	fn := sessionsFile(config.UserId, config.Profile)
+	pids, err := readSessions(fn)
+	if err != nil {
+		return 0, err
+	}
+
+	var left []int
+	for _, pid := range pids {
+		if pid != os.Getpid() {
+			left = append(left, pid)
+		}
+	}
+	return len(left), writeSessions(fn, left)
+}
+
+// removeSessionFiles removes the session ledger and activity record of a
+// container which was stopped or removed.
+func removeSessionFiles(uid int, profile string) {
+	os.Remove(sessionsFile(uid, profile))
+	os.Remove(activityFile(uid, profile))
+}
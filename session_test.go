@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_readSessions_1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockersh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "sessions")
+	pids, err := readSessions(fn)
+	if err != nil || len(pids) != 0 {
+		t.Errorf("Expected no sessions got %v (%v)", pids, err)
+	}
+
+	if err := writeSessions(fn, []int{os.Getpid(), 99999999}); err != nil {
+		t.Fatal(err)
+	}
+	pids, err = readSessions(fn)
+	if err != nil {
+		t.Errorf("Got error %v", err)
+	}
+	if !reflect.DeepEqual(pids, []int{os.Getpid()}) {
+		t.Errorf("Expected only the live pid got %v", pids)
+	}
+}
+
+func Test_sessionsFile_1(t *testing.T) {
+	fn := sessionsFile(1000, "fred/shell")
+	if fn != "/var/run/dockersh/1000.fred_shell.sessions" {
+		t.Errorf("Unexpected sessions file %s", fn)
+	}
+}
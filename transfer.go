@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// sftpServers are the usual locations of sftp-server in images, tried in
+// order when sftpserver isn't set.
+var sftpServers = []string{
+	"/usr/lib/openssh/sftp-server",
+	"/usr/libexec/openssh/sftp-server",
+	"/usr/lib/ssh/sftp-server",
+	"/usr/libexec/sftp-server",
+}
+
+// isFileTransfer reports whether the command is the server side of scp, rsync
+// or sftp. These need a binary clean stream, so they never get a tty.
+func isFileTransfer(command string) bool {
+	f := strings.Fields(command)
+	if len(f) == 0 {
+		return false
+	}
+
+	switch filepath.Base(f[0]) {
+	case "scp":
+		for _, a := range f[1:] {
+			if a == "--" {
+				break
+			}
+			if strings.HasPrefix(a, "-") && strings.ContainsAny(a[1:], "tf") {
+				return true
+			}
+		}
+	case "rsync":
+		for _, a := range f[1:] {
+			if a == "--server" {
+				return true
+			}
+		}
+	case "sftp-server", "internal-sftp":
+		return true
+	}
+
+	return false
+}
+
+// isSftp reports whether the command is the sftp subsystem. sshd runs it as
+// either internal-sftp or the path of sftp-server on the host, which may not
+// be where the image has it.
+func isSftp(command string) bool {
+	f := strings.Fields(command)
+	if len(f) == 0 {
+		return false
+	}
+	b := filepath.Base(f[0])
+	return b == "sftp-server" || b == "internal-sftp"
+}
+
+// sftpCommand returns the command running sftp-server inside the container,
+// with the arguments sshd gave it.
+func sftpCommand(config Configuration, command string) []string {
+	servers := sftpServers
+	if config.SftpServer != "" {
+		servers = []string{config.SftpServer}
+	}
+
+	script := `for p in ` + strings.Join(servers, " ") + `; do
+	if [ -x "$p" ]; then exec "$p" "$@"; fi
+done
+echo "dockersh: sftp-server not found in the container" >&2
+exit 127`
+
+	args := []string{"/bin/sh", "-c", script, "sftp-server"}
+	return append(args, strings.Fields(command)[1:]...)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_isFileTransfer_1(t *testing.T) {
+	for _, c := range []string{"scp -t .", "scp -p -t /home/fred", "scp -pf file", "/usr/bin/scp -f -- file", "rsync --server -vlogDtpre.iLsfxC . dir", "/usr/lib/openssh/sftp-server", "internal-sftp -l INFO"} {
+		if !isFileTransfer(c) {
+			t.Errorf("%s not detected as a file transfer", c)
+		}
+	}
+	for _, c := range []string{"", "scp file host:", "scp -- -t", "rsync -av a b", "make test"} {
+		if isFileTransfer(c) {
+			t.Errorf("%s detected as a file transfer", c)
+		}
+	}
+}
+
+func Test_sftpCommand_1(t *testing.T) {
+	args := sftpCommand(Configuration{SftpServer: "/opt/sftp-server"}, "internal-sftp -l INFO")
+	if len(args) != 6 || args[0] != "/bin/sh" || args[3] != "sftp-server" || args[4] != "-l" || args[5] != "INFO" {
+		t.Errorf("Unexpected sftp command %q", args)
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"os"
 	"os/user"
 	"strconv"
+	"strings"
 )
 
 func getCurrentUser() (username string, homedir string, uid int, gid int, err error) {
@@ -26,3 +29,98 @@ func getUser(user *user.User) (username string, homedir string, uid int, gid int
 	gid, err = strconv.Atoi(user.Gid)
 	return user.Username, user.HomeDir, uid, gid, nil
 }
+
+// subordinateID returns the start of the first subordinate id range of name
+// in a /etc/subuid or /etc/subgid style file.
+func subordinateID(filename string, name string) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || fields[0] != name {
+			continue
+		}
+		return strconv.Atoi(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("no subordinate ids for %s in %s", name, filename)
+}
+
+// passwdShell returns the login shell of username in a passwd style file.
+func passwdShell(filename string, username string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) != 7 || fields[0] != username {
+			continue
+		}
+		return fields[6], nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("no entry for %s in %s", username, filename)
+}
+
+// isMemberOf reports whether the current user is a member of the named group,
+// supplementary groups included.
+func isMemberOf(group string) (bool, error) {
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return false, err
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return false, err
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return false, err
+	}
+
+	for _, gid := range gids {
+		if gid == g.Gid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// userGroups returns the names of the groups of username, supplementary
+// groups included.
+func userGroups(username string) ([]string, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, gid := range gids {
+		g, err := user.LookupGroupId(gid)
+		if err != nil {
+			continue
+		}
+		groups = append(groups, g.Name)
+	}
+	return groups, nil
+}
@@ -1,7 +1,11 @@
 package main
 
-import "testing"
-import "os/user"
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"testing"
+)
 
 func Test_getCurrentUser_1(t *testing.T) {
 	_, _, _, _, err := getCurrentUser()
@@ -53,3 +57,49 @@ func Test_getUser_3(t *testing.T) {
 		t.Error("No error from getUser")
 	}
 }
+
+func Test_subordinateID_1(t *testing.T) {
+	f, err := ioutil.TempFile("", "subuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("fred:100000:65536\ndockremap:165536:65536\n")
+	f.Close()
+
+	start, err := subordinateID(f.Name(), "dockremap")
+	if err != nil {
+		t.Errorf("Got error %v", err)
+	}
+	if start != 165536 {
+		t.Errorf("Expected 165536 got %v", start)
+	}
+
+	_, err = subordinateID(f.Name(), "bill")
+	if err == nil {
+		t.Error("No error for missing user")
+	}
+}
+
+func Test_passwdShell_1(t *testing.T) {
+	f, err := ioutil.TempFile("", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("root:x:0:0:root:/root:/bin/bash\nfred:x:1000:1000:Fred,,,:/home/fred:/usr/bin/zsh\n")
+	f.Close()
+
+	shell, err := passwdShell(f.Name(), "fred")
+	if err != nil {
+		t.Errorf("Got error %v", err)
+	}
+	if shell != "/usr/bin/zsh" {
+		t.Errorf("Expected /usr/bin/zsh got %v", shell)
+	}
+
+	_, err = passwdShell(f.Name(), "bill")
+	if err == nil {
+		t.Error("No error for missing user")
+	}
+}